@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/oauth2"
+)
+
+// Reddit's OAuth endpoints. Authenticated API requests go to a different host than read-only ones
+const (
+	redditOAuthBaseURL  = "https://oauth.reddit.com"
+	redditTokenURL      = "https://www.reddit.com/api/v1/access_token"
+	redditTokenEndpoint = "/api/v1/access_token"
+)
+
+// redditCredentials are optional OAuth script app credentials. Authenticate
+// with a refresh token, or a username and password. Without a client ID,
+// grabbit uses Reddit's read-only API.
+// String redacts the secrets, so logging credentials is safe
+type redditCredentials struct {
+	ClientID     string
+	ClientSecret string
+	Username     string
+	Password     string
+	RefreshToken string
+}
+
+func (c redditCredentials) enabled() bool {
+	return c.ClientID != ""
+}
+
+func (c redditCredentials) validate() error {
+	if !c.enabled() {
+		if c.ClientSecret != "" || c.Username != "" || c.Password != "" || c.RefreshToken != "" {
+			return errors.New("Reddit credentials need a client ID")
+		}
+		return nil
+	}
+	if c.ClientSecret == "" {
+		return errors.New("Reddit credentials need a client secret")
+	}
+	if c.RefreshToken == "" && (c.Username == "" || c.Password == "") {
+		return errors.New("Reddit credentials need a refresh token, or a username and password")
+	}
+	return nil
+}
+
+func redact(secret string) string {
+	if secret == "" {
+		return ""
+	}
+	return "REDACTED"
+}
+
+func (c redditCredentials) String() string {
+	return fmt.Sprintf(
+		"{ClientID:%s ClientSecret:%s Username:%s Password:%s RefreshToken:%s}",
+		c.ClientID, redact(c.ClientSecret), c.Username, redact(c.Password), redact(c.RefreshToken),
+	)
+}
+
+func (c redditCredentials) GoString() string {
+	return c.String()
+}
+
+// passwordTokenSource gets tokens with the OAuth password grant
+type passwordTokenSource struct {
+	ctx      context.Context
+	config   *oauth2.Config
+	username string
+	password string
+}
+
+func (s passwordTokenSource) Token() (*oauth2.Token, error) {
+	return s.config.PasswordCredentialsToken(s.ctx, s.username, s.password)
+}
+
+// userAgentTransport sets the User-Agent header, which Reddit requires for every request, including token requests
+type userAgentTransport struct {
+	UserAgent string
+	Base      http.RoundTripper
+}
+
+func (t userAgentTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	req.Header.Set("User-Agent", t.UserAgent)
+	return t.Base.RoundTrip(req)
+}
+
+// oauthTransport adds an access token to requests made with base, getting a
+// new one from tokenURL when it expires
+func oauthTransport(creds redditCredentials, base http.RoundTripper, tokenURL string) http.RoundTripper {
+	config := &oauth2.Config{
+		ClientID:     creds.ClientID,
+		ClientSecret: creds.ClientSecret,
+		Endpoint: oauth2.Endpoint{
+			AuthURL:       "",
+			DeviceAuthURL: "",
+			TokenURL:      tokenURL,
+			AuthStyle:     oauth2.AuthStyleInHeader,
+		},
+		RedirectURL: "",
+		Scopes:      nil,
+	}
+	tokenClient := &http.Client{
+		Timeout:       0,
+		Transport:     base,
+		CheckRedirect: nil,
+		Jar:           nil,
+	}
+	ctx := context.WithValue(context.Background(), oauth2.HTTPClient, tokenClient)
+
+	var source oauth2.TokenSource
+	if creds.RefreshToken != "" {
+		source = config.TokenSource(ctx, &oauth2.Token{
+			AccessToken:  "",
+			TokenType:    "",
+			RefreshToken: creds.RefreshToken,
+			Expiry:       time.Time{},
+		})
+	} else {
+		source = oauth2.ReuseTokenSource(nil, passwordTokenSource{
+			ctx:      ctx,
+			config:   config,
+			username: creds.Username,
+			password: creds.Password,
+		})
+	}
+	return &oauth2.Transport{
+		Source: source,
+		Base:   base,
+	}
+}
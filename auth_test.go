@@ -0,0 +1,128 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRedditCredentials_validate(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name    string
+		creds   redditCredentials
+		wantErr bool
+	}{
+		{
+			name:    "none",
+			creds:   redditCredentials{ClientID: "", ClientSecret: "", Username: "", Password: "", RefreshToken: ""},
+			wantErr: false,
+		},
+		{
+			name:    "password",
+			creds:   redditCredentials{ClientID: "id", ClientSecret: "secret", Username: "bob", Password: "hunter2", RefreshToken: ""},
+			wantErr: false,
+		},
+		{
+			name:    "refresh token",
+			creds:   redditCredentials{ClientID: "id", ClientSecret: "secret", Username: "", Password: "", RefreshToken: "refresh"},
+			wantErr: false,
+		},
+		{
+			name:    "no client ID",
+			creds:   redditCredentials{ClientID: "", ClientSecret: "secret", Username: "", Password: "", RefreshToken: "refresh"},
+			wantErr: true,
+		},
+		{
+			name:    "no client secret",
+			creds:   redditCredentials{ClientID: "id", ClientSecret: "", Username: "", Password: "", RefreshToken: "refresh"},
+			wantErr: true,
+		},
+		{
+			name:    "no password",
+			creds:   redditCredentials{ClientID: "id", ClientSecret: "secret", Username: "bob", Password: "", RefreshToken: ""},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			err := tt.creds.validate()
+			if tt.wantErr {
+				require.Error(t, err)
+			} else {
+				require.NoError(t, err)
+			}
+		})
+	}
+}
+
+func TestRedditCredentials_String(t *testing.T) {
+	t.Parallel()
+
+	creds := redditCredentials{ClientID: "id", ClientSecret: "secret", Username: "bob", Password: "hunter2", RefreshToken: "refresh"}
+	for _, formatted := range []string{creds.String(), fmt.Sprintf("%v", creds), fmt.Sprintf("%+v", creds), fmt.Sprintf("%#v", creds)} {
+		require.Contains(t, formatted, "bob")
+		require.NotContains(t, formatted, "secret")
+		require.NotContains(t, formatted, "hunter2")
+		require.NotContains(t, formatted, "refresh")
+	}
+}
+
+func Test_newRedditClient_oauth(t *testing.T) {
+	t.Parallel()
+
+	var mu sync.Mutex
+	tokenRequests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Reddit requires a User-Agent, including on token requests
+		if !strings.HasSuffix(r.Header.Get("User-Agent"), "(go.bbkane.com/grabbit)") {
+			http.Error(w, "missing User-Agent", http.StatusForbidden)
+			return
+		}
+		switch r.URL.Path {
+		case redditTokenEndpoint:
+			id, secret, ok := r.BasicAuth()
+			if !ok || id != "id" || secret != "secret" || r.FormValue("grant_type") != "refresh_token" || r.FormValue("refresh_token") != "refresh" {
+				http.Error(w, "bad credentials", http.StatusUnauthorized)
+				return
+			}
+			mu.Lock()
+			tokenRequests++
+			mu.Unlock()
+			w.Header().Set("Content-Type", "application/json")
+			_, _ = w.Write([]byte(`{"access_token": "access", "token_type": "bearer", "expires_in": 3600}`))
+		case "/r/wallpapers/top":
+			if r.Header.Get("Authorization") != "Bearer access" {
+				http.Error(w, "unauthorized", http.StatusUnauthorized)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			_, _ = w.Write([]byte(`{"kind": "Listing", "data": {"after": "", "children": [{"kind": "t3", "data": {"id": "a"}}]}}`))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	creds := redditCredentials{ClientID: "id", ClientSecret: "secret", Username: "", Password: "", RefreshToken: "refresh"}
+	var noSettings httpSettings
+	client, err := newRedditClient(newHTTPTransport(noSettings), creds, server.URL)
+	require.NoError(t, err)
+
+	for range 2 {
+		posts, _, err := getListing(t.Context(), client, "r/wallpapers/top?limit=100")
+		require.NoError(t, err)
+		require.Len(t, posts, 1)
+	}
+	// the access token is reused until it expires
+	mu.Lock()
+	defer mu.Unlock()
+	require.Equal(t, 1, tokenRequests)
+}
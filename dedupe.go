@@ -0,0 +1,267 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.bbkane.com/logos"
+	"go.bbkane.com/warg"
+	"go.bbkane.com/warg/path"
+	"go.uber.org/zap"
+	lumberjack "gopkg.in/natefinch/lumberjack.v2"
+)
+
+// What to do with a downloaded image whose content matches a file already in the destination
+const (
+	duplicatesKeep     = "keep"
+	duplicatesDiscard  = "discard"
+	duplicatesHardlink = "hardlink"
+)
+
+// contentIndex maps content hashes to files, per destination directory. A
+// directory is indexed the first time it's used
+type contentIndex struct {
+	mu sync.Mutex
+	// known are hashes from the history, so files grabbit downloaded aren't hashed again
+	known map[string]knownHash
+	dirs  map[string]*dirIndex
+}
+
+// knownHash is a file's SHA-256 when it was recorded in the history
+type knownHash struct {
+	SHA256 string
+	Time   time.Time
+}
+
+// dirIndex is the index of a destination directory
+type dirIndex struct {
+	// ready is closed once the directory is scanned
+	ready chan struct{}
+	err   error
+	// hash -> file path
+	hashes map[string]string
+}
+
+func newContentIndex(known map[string]knownHash) *contentIndex {
+	return &contentIndex{
+		mu:    sync.Mutex{},
+		known: known,
+		dirs:  make(map[string]*dirIndex),
+	}
+}
+
+// isImageFile reports whether the file name has an extension grabbit downloads
+func isImageFile(name string) bool {
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".jpg", ".jpeg", ".png":
+		return true
+	default:
+		return false
+	}
+}
+
+func hashFile(filePath string) (string, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+	defer file.Close()
+
+	h := sha256.New()
+	_, err = io.Copy(h, file)
+	if err != nil {
+		return "", errors.Wrapf(err, "could not hash file: %#v", filePath)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// scan hashes the images under dir, except skip. Files in c.known that
+// haven't been modified since they were recorded aren't read again. It
+// doesn't need c.mu, since c.known isn't modified after newContentIndex
+func (c *contentIndex) scan(dir string, skip string) (map[string]string, error) {
+	hashes := make(map[string]string)
+	err := filepath.WalkDir(dir, func(filePath string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() || !isImageFile(d.Name()) || filePath == skip {
+			return nil
+		}
+		hash := ""
+		if known, ok := c.known[filePath]; ok {
+			info, err := d.Info()
+			if err == nil && !info.ModTime().After(known.Time) {
+				hash = known.SHA256
+			}
+		}
+		if hash == "" {
+			hash, err = hashFile(filePath)
+		}
+		if errors.Is(err, fs.ErrNotExist) {
+			// removed by a concurrent download
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if _, exists := hashes[hash]; !exists {
+			hashes[hash] = filePath
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "could not scan destination: %#v", dir)
+	}
+	return hashes, nil
+}
+
+// index returns dir's index, scanning it on first use. Only the first caller
+// for a directory scans it; the others wait for it without blocking
+// downloads to other directories
+func (c *contentIndex) index(dir string, skip string) (*dirIndex, error) {
+	c.mu.Lock()
+	d, exists := c.dirs[dir]
+	if !exists {
+		d = &dirIndex{ready: make(chan struct{}), err: nil, hashes: nil}
+		c.dirs[dir] = d
+	}
+	c.mu.Unlock()
+
+	if exists {
+		<-d.ready
+	} else {
+		d.hashes, d.err = c.scan(dir, skip)
+		close(d.ready)
+	}
+	return d, d.err
+}
+
+// lookupOrAdd returns the file in dir with the same hash as filePath. If
+// there isn't one, filePath is added to the index
+func (c *contentIndex) lookupOrAdd(dir string, hash string, filePath string) (string, bool, error) {
+	d, err := c.index(dir, filePath)
+	if err != nil {
+		return "", false, err
+	}
+
+	c.mu.Lock()
+	existing, found := d.hashes[hash]
+	if !found || existing == filePath {
+		d.hashes[hash] = filePath
+		c.mu.Unlock()
+		return "", false, nil
+	}
+	c.mu.Unlock()
+
+	if _, err := os.Stat(existing); err == nil {
+		return existing, true, nil
+	}
+	// the file was removed since it was indexed
+	c.mu.Lock()
+	d.hashes[hash] = filePath
+	c.mu.Unlock()
+	return "", false, nil
+}
+
+// resolveDuplicate replaces filePath with a hardlink to existing, or removes it, depending on duplicates
+func resolveDuplicate(duplicates string, existing string, filePath string) error {
+	err := os.Remove(filePath)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if duplicates == duplicatesHardlink {
+		err = os.Link(existing, filePath)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+	}
+	return nil
+}
+
+func dedupe(ctx warg.CmdContext) error {
+	// retrieve types:
+	lumberJackLogger := &lumberjack.Logger{
+		Filename:   ctx.Flags["--log-filename"].(path.Path).MustExpand(),
+		MaxAge:     ctx.Flags["--log-maxage"].(int),
+		MaxBackups: ctx.Flags["--log-maxbackups"].(int),
+		MaxSize:    ctx.Flags["--log-maxsize"].(int),
+		LocalTime:  true,
+		Compress:   false,
+	}
+
+	color, err := warg.ConditionallyEnableColor(ctx.Flags, os.Stdout)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error enabling color, continuing without: %s", err.Error())
+	}
+
+	zapLogger := logos.NewBBKaneZapLogger(lumberJackLogger, zap.DebugLevel, version)
+	logger := logos.New(zapLogger, color)
+	logger.LogOnPanic()
+
+	dir := ctx.Flags["--destination"].(path.Path).MustExpand()
+	algorithm := ctx.Flags["--perceptual-hash"].(string)
+	threshold := ctx.Flags["--perceptual-threshold"].(int)
+	remove := ctx.Flags["--remove"].(bool)
+
+	groups, err := findNearDuplicates(dir, algorithm, threshold, os.Stderr)
+	if err != nil {
+		logger.Errorw(
+			"could not find near-duplicates",
+			"destination", dir,
+			"err", err,
+		)
+		return fmt.Errorf("could not find near-duplicates: %w", err)
+	}
+	logger.Infow(
+		"found near-duplicates",
+		"destination", dir,
+		"algorithm", algorithm,
+		"threshold", threshold,
+		"groups", len(groups),
+	)
+
+	for _, group := range groups {
+		fmt.Printf("keep:   %s\n", group.Keep)
+		for _, dupe := range group.Duplicates {
+			if remove {
+				err := os.Remove(dupe)
+				if err != nil {
+					logger.Errorw(
+						"could not remove near-duplicate",
+						"filePath", dupe,
+						"err", err,
+					)
+					return fmt.Errorf("could not remove near-duplicate: %w", err)
+				}
+				logger.Infow(
+					"removed near-duplicate",
+					"filePath", dupe,
+					"kept", group.Keep,
+				)
+				fmt.Printf("remove: %s (removed)\n", dupe)
+			} else {
+				fmt.Printf("remove: %s\n", dupe)
+			}
+		}
+	}
+	if len(groups) == 0 {
+		fmt.Println("No near-duplicates found")
+	} else if !remove {
+		fmt.Println("Run again with --remove to remove the near-duplicates")
+	}
+
+	err = logger.Sync()
+	if err != nil {
+		return fmt.Errorf("could not sync logger: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestContentIndex(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	existing := filepath.Join(dir, "earthporn_lake_a.jpg")
+	require.NoError(t, os.WriteFile(existing, []byte("lake"), 0600))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "notes.txt"), []byte("lake"), 0600))
+
+	downloaded := filepath.Join(dir, "wallpapers_lake_b.jpg")
+	require.NoError(t, os.WriteFile(downloaded, []byte("lake"), 0600))
+	hash, err := hashFile(downloaded)
+	require.NoError(t, err)
+
+	c := newContentIndex(nil)
+	found, ok, err := c.lookupOrAdd(dir, hash, downloaded)
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.Equal(t, existing, found)
+
+	require.NoError(t, resolveDuplicate(duplicatesHardlink, existing, downloaded))
+	existingInfo, err := os.Stat(existing)
+	require.NoError(t, err)
+	downloadedInfo, err := os.Stat(downloaded)
+	require.NoError(t, err)
+	require.True(t, os.SameFile(existingInfo, downloadedInfo))
+
+	unique := filepath.Join(dir, "wallpapers_city_c.jpg")
+	require.NoError(t, os.WriteFile(unique, []byte("city"), 0600))
+	uniqueHash, err := hashFile(unique)
+	require.NoError(t, err)
+	_, ok, err = c.lookupOrAdd(dir, uniqueHash, unique)
+	require.NoError(t, err)
+	require.False(t, ok)
+
+	// unique is now indexed, so a copy of it is a duplicate
+	_, ok, err = c.lookupOrAdd(dir, uniqueHash, filepath.Join(dir, "cityporn_city_d.jpg"))
+	require.NoError(t, err)
+	require.True(t, ok)
+
+	require.NoError(t, resolveDuplicate(duplicatesDiscard, existing, downloaded))
+	require.NoFileExists(t, downloaded)
+}
+
+func TestContentIndex_known(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	recorded := filepath.Join(dir, "earthporn_lake_a.jpg")
+	modified := filepath.Join(dir, "earthporn_city_b.jpg")
+	require.NoError(t, os.WriteFile(recorded, []byte("lake"), 0600))
+	require.NoError(t, os.WriteFile(modified, []byte("city"), 0600))
+
+	// hashes from the history are used instead of reading files, unless the file changed since
+	c := newContentIndex(map[string]knownHash{
+		recorded: {SHA256: "recorded", Time: time.Now().Add(time.Hour)},
+		modified: {SHA256: "stale", Time: time.Now().Add(-time.Hour)},
+	})
+	found, ok, err := c.lookupOrAdd(dir, "recorded", filepath.Join(dir, "new.jpg"))
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.Equal(t, recorded, found)
+
+	_, ok, err = c.lookupOrAdd(dir, "stale", filepath.Join(dir, "new2.jpg"))
+	require.NoError(t, err)
+	require.False(t, ok)
+
+	cityHash, err := hashFile(modified)
+	require.NoError(t, err)
+	found, ok, err = c.lookupOrAdd(dir, cityHash, filepath.Join(dir, "new3.jpg"))
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.Equal(t, modified, found)
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"sync"
+	"text/tabwriter"
+
+	"github.com/pkg/errors"
+)
+
+// What grab would do with a post in a dry run
+const (
+	decisionDownload     = "download"
+	decisionExists       = "exists"
+	decisionInHistory    = "in-history"
+	decisionSkippedNSFW  = "skipped-nsfw"
+	decisionSkippedFlair = "skipped-flair"
+	decisionBadURL       = "bad-url"
+	decisionTooLongPath  = "too-long-path"
+)
+
+// dryRunRow is one line of the dry run table
+type dryRunRow struct {
+	Subreddit string
+	Title     string
+	URL       string
+	// FilePath is empty if the decision was made before the path was generated
+	FilePath string
+	Decision string
+}
+
+// dryRunPlan collects decisions from concurrent subreddits and prints them
+// grouped by subreddit, in the order the subreddits were first seen
+type dryRunPlan struct {
+	mu         sync.Mutex
+	subreddits []string
+	rows       map[string][]dryRunRow
+}
+
+func newDryRunPlan() *dryRunPlan {
+	return &dryRunPlan{
+		mu:         sync.Mutex{},
+		subreddits: nil,
+		rows:       make(map[string][]dryRunRow),
+	}
+}
+
+func (p *dryRunPlan) add(row dryRunRow) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if _, seen := p.rows[row.Subreddit]; !seen {
+		p.subreddits = append(p.subreddits, row.Subreddit)
+	}
+	p.rows[row.Subreddit] = append(p.rows[row.Subreddit], row)
+}
+
+// existsDecision returns whether downloading to filePath would find an existing file
+func existsDecision(filePath string) string {
+	_, err := os.Stat(filePath)
+	if errors.Is(err, fs.ErrNotExist) {
+		return decisionDownload
+	}
+	return decisionExists
+}
+
+func (p *dryRunPlan) print(w io.Writer) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "SUBREDDIT\tDECISION\tTITLE\tURL\tFILE PATH")
+	for _, name := range p.subreddits {
+		for _, r := range p.rows[name] {
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", r.Subreddit, r.Decision, r.Title, r.URL, r.FilePath)
+		}
+	}
+	return tw.Flush()
+}
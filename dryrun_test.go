@@ -0,0 +1,37 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDryRunPlan(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	existing := filepath.Join(dir, "wallpapers_a_a.jpg")
+	require.NoError(t, os.WriteFile(existing, []byte("image"), 0600))
+	missing := filepath.Join(dir, "wallpapers_b_b.jpg")
+
+	require.Equal(t, decisionExists, existsDecision(existing))
+	require.Equal(t, decisionDownload, existsDecision(missing))
+
+	plan := newDryRunPlan()
+	plan.add(dryRunRow{Subreddit: "wallpapers", Title: "a", URL: "https://i.redd.it/a.jpg", FilePath: existing, Decision: decisionExists})
+	plan.add(dryRunRow{Subreddit: "earthporn", Title: "c", URL: "https://example.com/c", FilePath: "", Decision: decisionBadURL})
+	plan.add(dryRunRow{Subreddit: "wallpapers", Title: "b", URL: "https://i.redd.it/b.jpg", FilePath: missing, Decision: decisionDownload})
+
+	var buf bytes.Buffer
+	require.NoError(t, plan.print(&buf))
+
+	lines := bytes.Split(bytes.TrimSpace(buf.Bytes()), []byte("\n"))
+	require.Len(t, lines, 4)
+	// grouped by subreddit in the order they were first seen
+	require.Contains(t, string(lines[1]), "wallpapers  exists")
+	require.Contains(t, string(lines[2]), "wallpapers  download")
+	require.Contains(t, string(lines[3]), "earthporn   bad-url")
+}
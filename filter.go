@@ -0,0 +1,122 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// aspectRatio is an allowed width:height ratio, plus or minus Tolerance percent
+type aspectRatio struct {
+	Width     float64
+	Height    float64
+	Tolerance float64
+}
+
+// parseAspectRatio parses "<width>:<height>[~<tolerance>%]"
+// parseAspectRatio("16:9~5%") -> aspectRatio{Width: 16, Height: 9, Tolerance: 5}, nil
+func parseAspectRatio(s string) (aspectRatio, error) {
+	ratio, tolerance, hasTolerance := strings.Cut(s, "~")
+	widthStr, heightStr, found := strings.Cut(ratio, ":")
+	if !found {
+		return aspectRatio{}, fmt.Errorf("invalid aspect ratio, expected <width>:<height>[~<tolerance>%%]: %s", s)
+	}
+	width, err := strconv.ParseFloat(widthStr, 64)
+	if err != nil || width <= 0 {
+		return aspectRatio{}, fmt.Errorf("invalid aspect ratio width: %s", s)
+	}
+	height, err := strconv.ParseFloat(heightStr, 64)
+	if err != nil || height <= 0 {
+		return aspectRatio{}, fmt.Errorf("invalid aspect ratio height: %s", s)
+	}
+	tol := 0.0
+	if hasTolerance {
+		tol, err = strconv.ParseFloat(strings.TrimSuffix(tolerance, "%"), 64)
+		if err != nil || tol < 0 {
+			return aspectRatio{}, fmt.Errorf("invalid aspect ratio tolerance: %s", s)
+		}
+	}
+	return aspectRatio{Width: width, Height: height, Tolerance: tol}, nil
+}
+
+func (a aspectRatio) String() string {
+	return fmt.Sprintf("%g:%g~%g%%", a.Width, a.Height, a.Tolerance)
+}
+
+// matches reports whether width x height is within the ratio's tolerance.
+// Without a tolerance, the ratio must match exactly, so "16:9" doesn't match
+// 1366x768 but "16:9~1%" does
+func (a aspectRatio) matches(width int, height int) bool {
+	if height == 0 {
+		return false
+	}
+	want := a.Width / a.Height
+	got := float64(width) / float64(height)
+	return math.Abs(got-want)/want <= a.Tolerance/100
+}
+
+// imageFilter rejects images by their dimensions. Zero values don't filter
+type imageFilter struct {
+	MinWidth     int
+	MinHeight    int
+	AspectRatios []aspectRatio
+}
+
+// enabled reports whether the filter needs image dimensions
+func (f imageFilter) enabled() bool {
+	return f.MinWidth > 0 || f.MinHeight > 0 || len(f.AspectRatios) > 0
+}
+
+// withOverrides returns a copy of f with the non-zero fields of o replacing f's
+func (f imageFilter) withOverrides(o imageFilter) imageFilter {
+	if o.MinWidth > 0 {
+		f.MinWidth = o.MinWidth
+	}
+	if o.MinHeight > 0 {
+		f.MinHeight = o.MinHeight
+	}
+	if len(o.AspectRatios) > 0 {
+		f.AspectRatios = o.AspectRatios
+	}
+	return f
+}
+
+// check returns an imageRejectedError if the dimensions don't pass the filter
+func (f imageFilter) check(width int, height int) error {
+	if width < f.MinWidth || height < f.MinHeight {
+		return &imageRejectedError{
+			Width:  width,
+			Height: height,
+			Reason: fmt.Sprintf("smaller than %dx%d", f.MinWidth, f.MinHeight),
+		}
+	}
+	if len(f.AspectRatios) == 0 {
+		return nil
+	}
+	for _, ratio := range f.AspectRatios {
+		if ratio.matches(width, height) {
+			return nil
+		}
+	}
+	allowed := make([]string, 0, len(f.AspectRatios))
+	for _, ratio := range f.AspectRatios {
+		allowed = append(allowed, ratio.String())
+	}
+	return &imageRejectedError{
+		Width:  width,
+		Height: height,
+		Reason: "aspect ratio not in " + strings.Join(allowed, ", "),
+	}
+}
+
+// imageRejectedError is returned by downloadImage when an image doesn't pass its imageFilter
+type imageRejectedError struct {
+	Width  int
+	Height int
+	Reason string
+}
+
+func (e *imageRejectedError) Error() string {
+	return fmt.Sprintf("image rejected: %dx%d: %s", e.Width, e.Height, e.Reason)
+}
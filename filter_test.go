@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestImageFilter_check(t *testing.T) {
+	t.Parallel()
+
+	sixteenNine, err := parseAspectRatio("16:9~5%")
+	require.NoError(t, err)
+
+	tests := []struct {
+		name    string
+		filter  imageFilter
+		width   int
+		height  int
+		wantErr bool
+	}{
+		{name: "no filter", filter: imageFilter{MinWidth: 0, MinHeight: 0, AspectRatios: nil}, width: 640, height: 480, wantErr: false},
+		{name: "too narrow", filter: imageFilter{MinWidth: 1920, MinHeight: 0, AspectRatios: nil}, width: 1280, height: 1080, wantErr: true},
+		{name: "too short", filter: imageFilter{MinWidth: 0, MinHeight: 1080, AspectRatios: nil}, width: 1920, height: 720, wantErr: true},
+		{name: "16:9", filter: imageFilter{MinWidth: 0, MinHeight: 0, AspectRatios: []aspectRatio{sixteenNine}}, width: 3840, height: 2160, wantErr: false},
+		{name: "1920x1110 within 5% of 16:9", filter: imageFilter{MinWidth: 0, MinHeight: 0, AspectRatios: []aspectRatio{sixteenNine}}, width: 1920, height: 1110, wantErr: false},
+		{name: "1920x1140 just over 5% from 16:9", filter: imageFilter{MinWidth: 0, MinHeight: 0, AspectRatios: []aspectRatio{sixteenNine}}, width: 1920, height: 1140, wantErr: true},
+		{name: "16:10 not within 5% of 16:9", filter: imageFilter{MinWidth: 0, MinHeight: 0, AspectRatios: []aspectRatio{sixteenNine}}, width: 1920, height: 1200, wantErr: true},
+		{name: "portrait", filter: imageFilter{MinWidth: 0, MinHeight: 0, AspectRatios: []aspectRatio{sixteenNine}}, width: 1080, height: 1920, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.filter.check(tt.width, tt.height)
+			if tt.wantErr {
+				var rejected *imageRejectedError
+				require.ErrorAs(t, err, &rejected)
+				require.Equal(t, tt.width, rejected.Width)
+				require.Equal(t, tt.height, rejected.Height)
+			} else {
+				require.NoError(t, err)
+			}
+		})
+	}
+}
+
+func Test_parseAspectRatio(t *testing.T) {
+	t.Parallel()
+
+	for _, bad := range []string{"16", "16:x", "0:9", "16:9~", "16:9~-1%"} {
+		_, err := parseAspectRatio(bad)
+		require.Error(t, err, bad)
+	}
+	got, err := parseAspectRatio("21:9")
+	require.NoError(t, err)
+	require.Equal(t, aspectRatio{Width: 21, Height: 9, Tolerance: 0}, got)
+}
+
+func Test_downloadImage_filter(t *testing.T) {
+	t.Parallel()
+
+	var buf bytes.Buffer
+	err := png.Encode(&buf, image.NewGray(image.Rect(0, 0, 64, 48)))
+	require.NoError(t, err)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write(buf.Bytes())
+	}))
+	defer server.Close()
+
+	dir := t.TempDir()
+
+	rejectPath := filepath.Join(dir, "rejected.png")
+	_, err = downloadImage(t.Context(), server.Client(), server.URL, rejectPath, imageFilter{MinWidth: 100, MinHeight: 0, AspectRatios: nil}, 0, 0)
+	var rejected *imageRejectedError
+	require.ErrorAs(t, err, &rejected)
+	require.Equal(t, 64, rejected.Width)
+	require.Equal(t, 48, rejected.Height)
+	require.NoFileExists(t, rejectPath)
+
+	okPath := filepath.Join(dir, "ok.png")
+	result, err := downloadImage(t.Context(), server.Client(), server.URL, okPath, imageFilter{MinWidth: 64, MinHeight: 48, AspectRatios: nil}, 0, 0)
+	require.NoError(t, err)
+	require.Equal(t, int64(buf.Len()), result.Bytes)
+	written, err := os.ReadFile(okPath)
+	require.NoError(t, err)
+	require.Equal(t, buf.Bytes(), written)
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/vartanbeno/go-reddit/v2/reddit"
+)
+
+// galleryPost holds the parts of a post's JSON that go-reddit doesn't decode
+type galleryPost struct {
+	GalleryData struct {
+		Items []struct {
+			MediaID string `json:"media_id"`
+		} `json:"items"`
+	} `json:"gallery_data"`
+	MediaMetadata map[string]struct {
+		Status string `json:"status"`
+		E      string `json:"e"`
+		M      string `json:"m"`
+	} `json:"media_metadata"`
+}
+
+// galleryResolver downloads every image in a reddit.com/gallery/<id> post
+type galleryResolver struct {
+	Client *reddit.Client
+	Lim    limiter
+}
+
+func (r *galleryResolver) Name() string {
+	return resolverGallery
+}
+
+func (r *galleryResolver) Matches(post *reddit.Post) bool {
+	_, ok := galleryID(post.URL)
+	return ok
+}
+
+func (r *galleryResolver) Resolve(ctx context.Context, post *reddit.Post) ([]imageCandidate, error) {
+	id, ok := galleryID(post.URL)
+	if !ok {
+		return nil, errors.Errorf("not a gallery URL: %#v", post.URL)
+	}
+	err := r.Lim.acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Lim.release()
+	return getGalleryImages(ctx, r.Client, id)
+}
+
+// galleryID returns the post ID from a gallery URL
+// galleryID("https://www.reddit.com/gallery/abc123") -> "abc123", true
+func galleryID(fullURL string) (string, bool) {
+	galleryURL, err := url.Parse(fullURL)
+	if err != nil {
+		return "", false
+	}
+	host := strings.ToLower(galleryURL.Hostname())
+	if host != "reddit.com" && !strings.HasSuffix(host, ".reddit.com") {
+		return "", false
+	}
+	id, found := strings.CutPrefix(strings.Trim(galleryURL.Path, "/"), "gallery/")
+	if !found || id == "" || strings.Contains(id, "/") {
+		return "", false
+	}
+	return id, true
+}
+
+// getGalleryImages looks up a gallery post's media metadata and returns its images in gallery order
+func getGalleryImages(ctx context.Context, client *reddit.Client, id string) ([]imageCandidate, error) {
+	req, err := client.NewRequest(http.MethodGet, "comments/"+id, nil)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	// comments/<id> returns the post listing followed by the comment listing
+	var listings []struct {
+		Data struct {
+			Children []struct {
+				Data galleryPost `json:"data"`
+			} `json:"children"`
+		} `json:"data"`
+	}
+	_, err = client.Do(ctx, req, &listings)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if len(listings) == 0 || len(listings[0].Data.Children) == 0 {
+		return nil, errors.Errorf("no post found for gallery: %#v", id)
+	}
+	post := listings[0].Data.Children[0].Data
+
+	images := []imageCandidate{}
+	for i, item := range post.GalleryData.Items {
+		media, ok := post.MediaMetadata[item.MediaID]
+		if !ok || media.Status != "valid" || media.E != "Image" {
+			continue
+		}
+		var ext string
+		switch media.M {
+		case "image/jpg", "image/jpeg":
+			ext = ".jpg"
+		case "image/png":
+			ext = ".png"
+		default:
+			continue
+		}
+		images = append(images, imageCandidate{
+			URL:  "https://i.redd.it/" + item.MediaID + ext,
+			Name: indexedName(item.MediaID, i+1),
+			Ext:  ext,
+		})
+	}
+	if len(images) == 0 {
+		return nil, errors.Errorf("no downloadable images in gallery: %#v", id)
+	}
+	return images, nil
+}
+
+// indexedName adds an index suffix to a file name so gallery and album images sort in order
+// indexedName("abc", 2) -> "abc_02"
+func indexedName(name string, index int) string {
+	return fmt.Sprintf("%s_%02d", name, index)
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func Test_galleryID(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		name   string
+		url    string
+		wantID string
+		wantOK bool
+	}{
+		{name: "www", url: "https://www.reddit.com/gallery/abc123", wantID: "abc123", wantOK: true},
+		{name: "bare", url: "https://reddit.com/gallery/abc123/", wantID: "abc123", wantOK: true},
+		{name: "not gallery", url: "https://www.reddit.com/r/wallpapers/comments/abc123", wantID: "", wantOK: false},
+		{name: "other host", url: "https://example.com/gallery/abc123", wantID: "", wantOK: false},
+		{name: "image", url: "https://i.redd.it/abc123.jpg", wantID: "", wantOK: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			id, ok := galleryID(tt.url)
+			require.Equal(t, tt.wantOK, ok)
+			require.Equal(t, tt.wantID, id)
+		})
+	}
+}
+
+func Test_getGalleryImages(t *testing.T) {
+	t.Parallel()
+
+	const body = `[
+  {"kind": "Listing", "data": {"children": [{"kind": "t3", "data": {
+    "gallery_data": {"items": [{"media_id": "first"}, {"media_id": "vid"}, {"media_id": "third"}]},
+    "media_metadata": {
+      "first": {"status": "valid", "e": "Image", "m": "image/jpg"},
+      "vid": {"status": "valid", "e": "AnimatedImage", "m": "image/gif"},
+      "third": {"status": "valid", "e": "Image", "m": "image/png"}
+    }
+  }}]}},
+  {"kind": "Listing", "data": {"children": []}}
+]`
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/comments/abc123" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(body))
+	}))
+	defer server.Close()
+
+	var noSettings httpSettings
+	var noCredentials redditCredentials
+	client, err := newRedditClient(newHTTPTransport(noSettings), noCredentials, server.URL)
+	require.NoError(t, err)
+
+	images, err := getGalleryImages(t.Context(), client, "abc123")
+	require.NoError(t, err)
+	require.Equal(t, []imageCandidate{
+		{URL: "https://i.redd.it/first.jpg", Name: "first_01", Ext: ".jpg"},
+		{URL: "https://i.redd.it/third.png", Name: "third_03", Ext: ".png"},
+	}, images)
+
+	_, err = getGalleryImages(t.Context(), client, "missing")
+	require.Error(t, err)
+}
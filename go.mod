@@ -10,6 +10,8 @@ require (
 	go.bbkane.com/logos v0.4.0
 	go.bbkane.com/warg v0.40.0
 	go.uber.org/zap v1.27.1
+	golang.org/x/oauth2 v0.21.0
+	golang.org/x/sys v0.35.0
 	gopkg.in/natefinch/lumberjack.v2 v2.2.1
 )
 
@@ -32,6 +34,4 @@ require (
 	go.bbkane.com/gocolor v0.0.5 // indirect
 	go.uber.org/multierr v1.11.0 // indirect
 	golang.org/x/net v0.26.0 // indirect
-	golang.org/x/oauth2 v0.21.0 // indirect
-	golang.org/x/sys v0.35.0 // indirect
 )
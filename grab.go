@@ -1,17 +1,29 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
 	"context"
+	"crypto/sha256"
 	"crypto/tls"
+	"encoding/hex"
 	"fmt"
+	"hash"
+	"image"
+	_ "image/jpeg" // register decoders for image.DecodeConfig
+	_ "image/png"
 	"io"
+	"io/fs"
 	"net"
 	"net/http"
 	"net/url"
 	"os"
+	"os/signal"
 	"path/filepath"
-	"runtime"
+	"strconv"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/bbkane/glib"
@@ -28,14 +40,76 @@ import (
 type subreddit struct {
 	Name        string
 	Destination string
+	Sort        string
 	Timeframe   string
+	Search      string
+	Flairs      flairFilter
 	Count       int
+	Resolvers   []Resolver
+	Filter      imageFilter
+	// TimeBudget limits how long the subreddit is grabbed for. 0 means no limit
+	TimeBudget time.Duration
+	Report     *subredditReport
 }
 
-// downloadImage does not overwrite existing files
-func downloadImage(URL string, fileName string) error {
+// limiter bounds the number of network operations (Reddit API calls and
+// image downloads) in flight at once
+type limiter chan struct{}
 
-	// TODO: add tests! This is tricksy
+func newLimiter(concurrency int) limiter {
+	return make(limiter, concurrency)
+}
+
+// acquire waits for a slot. It returns ctx's error instead if ctx is done
+// first, and then the slot must not be released
+func (l limiter) acquire(ctx context.Context) error {
+	if ctx.Err() != nil {
+		return errors.WithStack(ctx.Err())
+	}
+	select {
+	case l <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return errors.WithStack(ctx.Err())
+	}
+}
+
+func (l limiter) release() {
+	<-l
+}
+
+// headerPeekSize is how much of an image downloadImage reads before writing
+// to disk. JPEGs can have large EXIF blocks before the dimensions
+const headerPeekSize = 128 * 1024
+
+// downloadResult describes a downloaded image
+type downloadResult struct {
+	// SHA256 is the hex encoded hash of the image's content
+	SHA256 string
+	Bytes  int64
+}
+
+// imageTooLargeError means an image is larger than the download size cap
+type imageTooLargeError struct {
+	MaxBytes int64
+}
+
+func (e *imageTooLargeError) Error() string {
+	return fmt.Sprintf("image is larger than the download size cap of %d bytes", e.MaxBytes)
+}
+
+// downloadImage does not overwrite existing files. It returns an
+// *imageRejectedError if the image doesn't pass filter, and an
+// *imageTooLargeError if it's larger than maxBytes (0 means no cap).
+// The image is written to a partial file in fileName's directory, synced,
+// checked against the response's length, and then renamed to fileName, so
+// fileName is either missing or complete. If the transfer is interrupted,
+// the partial file is kept and resumed with a Range request, now or on the
+// next run. If the server doesn't send an ETag or Last-Modified to check the
+// partial file against, the download starts over instead. timeout bounds
+// each attempt, so a slow image that keeps making progress isn't given up on
+// (0 means no limit)
+func downloadImage(ctx context.Context, client *http.Client, URL string, fileName string, filter imageFilter, maxBytes int64, timeout time.Duration) (downloadResult, error) {
 
 	// TODO: use the following process to get the right file extension
 	// We need the file extension to check whether the file exists when we open
@@ -44,82 +118,206 @@ func downloadImage(URL string, fileName string) error {
 	// - try a HEAD request from the server
 	// - download 512 bytes from a GET request and check the mime type maybe (or give up :D)
 
-	// putting the file logic first because it's the cheapest
-	// O_EXCL - used with O_CREATE, file must not exist
+	// putting the file logic first because it's the cheapest. renameNoReplace
+	// checks again, in case fileName was created during the download
+	if _, err := os.Lstat(fileName); err == nil {
+		return downloadResult{}, errors.WithStack(&fs.PathError{Op: "download", Path: fileName, Err: fs.ErrExist})
+	}
+
+	partial := newPartialFile(fileName)
+	for attempt := 0; ; attempt++ {
+		attemptCtx := ctx
+		cancel := func() {}
+		if timeout > 0 {
+			attemptCtx, cancel = context.WithTimeout(ctx, timeout)
+		}
+		result, retry, err := downloadAttempt(attemptCtx, client, URL, fileName, partial, filter, maxBytes)
+		cancel()
+		if err == nil {
+			return result, nil
+		}
+		if !retry || attempt >= maxResumeAttempts || ctx.Err() != nil {
+			return downloadResult{}, err
+		}
+	}
+}
 
-	// Gonna use os.O_TRUNC now to always create the file for testing
-	// file, err := os.OpenFile(fileName, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
-	file, err := os.OpenFile(fileName, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0666)
+// downloadAttempt resumes the partial download of URL if there's one, and
+// starts a new one otherwise. It returns whether another attempt could make
+// progress
+func downloadAttempt(ctx context.Context, client *http.Client, URL string, fileName string, partial partialFile, filter imageFilter, maxBytes int64) (downloadResult, bool, error) {
+	meta, resumable := partial.load(URL)
+
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, URL, nil)
 	if err != nil {
-		return errors.WithStack(err)
+		return downloadResult{}, false, errors.WithStack(err)
 	}
-	defer file.Close()
+	if resumable {
+		request.Header.Set("Range", "bytes="+strconv.FormatInt(meta.Bytes, 10)+"-")
+		// the server sends the whole image if it changed
+		request.Header.Set("If-Range", meta.validator())
+	}
+	response, err := client.Do(request)
+	if err != nil {
+		return downloadResult{}, false, errors.WithStack(err)
+	}
+	defer response.Body.Close()
 
-	err = func() error {
-		response, err := http.Get(URL)
-		if err != nil {
-			return errors.WithStack(err)
+	if resumable {
+		switch response.StatusCode {
+		case http.StatusPartialContent:
+			return resumeDownload(response, fileName, partial, meta, maxBytes)
+		case http.StatusOK:
+			// the server doesn't support ranges or the image changed
+		case http.StatusRequestedRangeNotSatisfiable:
+			partial.remove()
+			return downloadResult{}, true, errors.Errorf("can't resume download, starting over: %+v\n", URL)
+		default:
+			// keep the partial file, the error may be temporary
+			return downloadResult{}, false, errors.Errorf("unexpected status resuming download: %d: %+v\n", response.StatusCode, URL)
 		}
-		defer response.Body.Close()
+	}
 
-		// -- make sure Content-Type is an image
+	if maxBytes > 0 && response.ContentLength > maxBytes {
+		partial.remove()
+		return downloadResult{}, false, errors.WithStack(&imageTooLargeError{MaxBytes: maxBytes})
+	}
 
-		contentBytes := make([]byte, 512)
+	// Peek (without consuming) enough of the body to check the content
+	// type and, if filtering, decode the image header
+	body := bufio.NewReaderSize(response.Body, headerPeekSize)
+	peeked, err := body.Peek(headerPeekSize)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return downloadResult{}, false, errors.Wrapf(err, "Could not read image header: %+v\n", URL)
+	}
 
-		_, err = response.Body.Read(contentBytes)
-		if err != nil {
-			return errors.Wrapf(err, "Could not read contentBytes: %+v\n", URL)
-		}
+	// -- make sure Content-Type is an image
 
-		// https://golang.org/pkg/net/http/#DetectContentType
-		contentType := http.DetectContentType(contentBytes)
+	// https://golang.org/pkg/net/http/#DetectContentType
+	contentType := http.DetectContentType(peeked)
 
-		if contentType != "image/jpeg" && contentType != "image/png" {
-			err = errors.Errorf("contentType is not 'image/jpeg' or 'image/png': %+v\n", contentType)
-			return err
-		}
+	if contentType != "image/jpeg" && contentType != "image/png" {
+		partial.remove()
+		err = errors.Errorf("contentType is not 'image/jpeg' or 'image/png': %+v\n", contentType)
+		return downloadResult{}, false, err
+	}
 
-		_, err = file.Write(contentBytes)
+	if filter.enabled() {
+		config, _, err := image.DecodeConfig(bytes.NewReader(peeked))
 		if err != nil {
-			return errors.Wrapf(err, "can't write contentBytes to file: %+v, %+v\n", URL, file.Name())
+			partial.remove()
+			return downloadResult{}, false, errors.Wrapf(err, "could not decode image dimensions: %+v\n", URL)
 		}
-
-		_, err = io.Copy(file, response.Body)
+		err = filter.check(config.Width, config.Height)
 		if err != nil {
-			return errors.Wrapf(err, "Can't copy to file: %+v, %+v\n", URL, file.Name())
+			partial.remove()
+			return downloadResult{}, false, err
 		}
-		return nil
-	}()
+	}
+
+	file, err := os.OpenFile(partial.DataPath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
 	if err != nil {
-		_ = os.Remove(fileName)
+		return downloadResult{}, false, errors.WithStack(err)
 	}
-	return err
+	defer file.Close()
+	meta = newPartialMeta(URL, response.Header)
+	err = partial.save(meta)
+	if err != nil {
+		partial.remove()
+		return downloadResult{}, false, err
+	}
+
+	// hash while writing so duplicates can be found without reading the file again
+	hash := sha256.New()
+	return finishDownload(file, hash, body, response.ContentLength, fileName, partial, meta, maxBytes)
 }
 
-func genFilePath(destinationDir string, subredditName string, title string, urlFileName string) (string, error) {
+// resumeDownload appends a 206 response to the partial file
+func resumeDownload(response *http.Response, fileName string, partial partialFile, meta partialMeta, maxBytes int64) (downloadResult, bool, error) {
+	start, total, err := parseContentRange(response.Header.Get("Content-Range"))
+	if err != nil || start != meta.Bytes {
+		partial.remove()
+		return downloadResult{}, true, errors.Errorf("server resumed at the wrong offset, starting over: %+v\n", meta.URL)
+	}
+	if maxBytes > 0 && total > maxBytes {
+		partial.remove()
+		return downloadResult{}, false, errors.WithStack(&imageTooLargeError{MaxBytes: maxBytes})
+	}
+
+	file, err := os.OpenFile(partial.DataPath, os.O_RDWR, 0666)
+	if err != nil {
+		return downloadResult{}, false, errors.WithStack(err)
+	}
+	defer file.Close()
 
-	for _, s := range []string{" ", "/", "\\", "\n", "\r", "\x00"} {
-		urlFileName = strings.ReplaceAll(urlFileName, s, "_")
-		subredditName = strings.ReplaceAll(subredditName, s, "_")
-		title = strings.ReplaceAll(title, s, "_")
+	// hash what's already downloaded, leaving the offset at the end
+	hash := sha256.New()
+	hashed, err := io.Copy(hash, file)
+	if err != nil || hashed != meta.Bytes {
+		partial.remove()
+		return downloadResult{}, true, errors.Errorf("partial file changed, starting over: %+v\n", partial.DataPath)
+	}
+	remaining := int64(-1)
+	if total >= 0 {
+		remaining = total - meta.Bytes
+	}
+	return finishDownload(file, hash, response.Body, remaining, fileName, partial, meta, maxBytes)
+}
+
+// finishDownload copies body to the end of the partial file and renames it
+// to fileName once it has all expected bytes (if known). If the copy is
+// interrupted, the metadata is updated so the download can be resumed
+func finishDownload(file *os.File, h hash.Hash, body io.Reader, expected int64, fileName string, partial partialFile, meta partialMeta, maxBytes int64) (downloadResult, bool, error) {
+	if maxBytes > 0 {
+		// read one byte past the cap to tell if it's exceeded
+		body = io.LimitReader(body, maxBytes-meta.Bytes+1)
+	}
+	written, copyErr := io.Copy(io.MultiWriter(file, h), body)
+	if maxBytes > 0 && meta.Bytes+written > maxBytes {
+		partial.remove()
+		return downloadResult{}, false, errors.WithStack(&imageTooLargeError{MaxBytes: maxBytes})
 	}
+	if copyErr == nil && expected >= 0 && written != expected {
+		copyErr = errors.Errorf("download truncated: got %d of %d bytes: %+v\n", written, expected, meta.URL)
+	}
+	meta.Bytes += written
 
-	fullFileName := subredditName + "_" + title + "_" + urlFileName
-	filePath := filepath.Join(destinationDir, fullFileName)
+	err := file.Sync()
+	if err != nil {
+		partial.remove()
+		return downloadResult{}, false, errors.WithStack(err)
+	}
 
-	// remove chars from title if it's too long for the OS to handle
-	const maxPathLength = 250
-	if len(filePath) > maxPathLength {
-		toChop := len(filePath) - maxPathLength
-		if toChop > len(title) {
-			return "", errors.Errorf("filePath to long and title too short: %#v\n", filePath)
+	if copyErr != nil {
+		if meta.Bytes == 0 || meta.validator() == "" {
+			// nothing to resume from, or no way to tell if the image changed,
+			// so the next attempt starts over
+			partial.remove()
+			return downloadResult{}, true, errors.Wrapf(copyErr, "Can't copy to file: %+v, %+v\n", meta.URL, partial.DataPath)
 		}
+		err = partial.save(meta)
+		if err != nil {
+			partial.remove()
+			return downloadResult{}, false, err
+		}
+		return downloadResult{}, written > 0, errors.Wrapf(copyErr, "download interrupted after %d bytes, keeping partial file: %+v, %+v\n", meta.Bytes, meta.URL, partial.DataPath)
+	}
 
-		title = title[:len(title)-toChop]
-		fullFileName = subredditName + "_" + title + "_" + urlFileName
-		filePath = filepath.Join(destinationDir, fullFileName)
+	err = file.Close()
+	if err != nil {
+		partial.remove()
+		return downloadResult{}, false, errors.WithStack(err)
+	}
+	err = renameNoReplace(partial.DataPath, fileName)
+	if err != nil {
+		partial.remove()
+		return downloadResult{}, false, err
 	}
-	return filePath, nil
+	_ = os.Remove(partial.MetaPath)
+	return downloadResult{
+		SHA256: hex.EncodeToString(h.Sum(nil)),
+		Bytes:  meta.Bytes,
+	}, false, nil
 }
 
 // validateImageURL tries to extract a valid image file name from a URL
@@ -144,28 +342,32 @@ func validateImageURL(fullURL string) (string, error) {
 	return "", errors.Errorf("urlFileName doesn't end in allowed extension: %#v , %#v\n ", urlFileName, allowedImageExtensions)
 }
 
-// getTopPosts retrieves the top posts for a given subreddit and returns them as an array of `reddit.Post` pointers.
-// Set baseURL to a non-empty string to override where the HTTP requests go, useful for tests
-func getTopPosts(ctx context.Context, timeout time.Duration, logger *logos.Logger, sr subreddit, baseURL string) ([]*reddit.Post, error) {
+// newRedditClient builds a Reddit client. It's authenticated if creds are
+// enabled, and read-only otherwise. Share transport between clients so they
+// share its rate limit state. Timeouts are up to transport, so they can
+// apply per attempt instead of across retries.
+// Set baseURL to a non-empty string to override where the HTTP requests go, including token requests, useful for tests
+func newRedditClient(transport http.RoundTripper, creds redditCredentials, baseURL string) (*reddit.Client, error) {
 
-	ua := runtime.GOOS + ":" + "grabbit" + ":" + version + " (go.bbkane.com/grabbit)"
-
-	var transport http.Transport
-	transport.Proxy = http.ProxyFromEnvironment
-	// https://www.reddit.com/r/redditdev/comments/uncu00/comment/i8gyfmx/
-	transport.ForceAttemptHTTP2 = true
-	transport.MaxIdleConns = 100
-	transport.IdleConnTimeout = 90 * time.Second
-	transport.TLSHandshakeTimeout = 10 * time.Second
-	transport.ExpectContinueTimeout = 1 * time.Second
+	ua := userAgent()
 
 	httpClient := &http.Client{
-		Timeout:       timeout,
-		Transport:     &transport,
+		Timeout:       0,
+		Transport:     transport,
 		CheckRedirect: nil,
 		Jar:           nil,
 	}
 
+	if creds.enabled() {
+		tokenURL := redditTokenURL
+		if baseURL == "" {
+			baseURL = redditOAuthBaseURL
+		} else {
+			tokenURL = baseURL + redditTokenEndpoint
+		}
+		httpClient.Transport = oauthTransport(creds, userAgentTransport{UserAgent: ua, Base: transport}, tokenURL)
+	}
+
 	var client *reddit.Client
 	var redditErr error
 	if baseURL == "" {
@@ -180,96 +382,557 @@ func getTopPosts(ctx context.Context, timeout time.Duration, logger *logos.Logge
 			reddit.WithHTTPClient(httpClient),
 		)
 	}
-
 	if redditErr != nil {
-		err := errors.WithStack(redditErr)
+		return nil, errors.WithStack(redditErr)
+	}
+	return client, nil
+}
+
+// getPosts retrieves a page of a subreddit's posts, sorted by sr.Sort or matching sr.Search, after the after cursor.
+// It returns them with the cursor for the next page.
+// Requests are retried by the client's transport. If Reddit reports the rate limit was exceeded, getPosts waits
+// for it to reset and retries up to maxRetries more times
+func getPosts(ctx context.Context, client *reddit.Client, maxRetries int, logger *logos.Logger, sr subreddit, after string) ([]listedPost, string, error) {
+	for retry := 0; ; retry++ {
+		posts, next, err := getListing(ctx, client, listingPath(sr, after))
+		var rateLimited *reddit.RateLimitError
+		if !errors.As(err, &rateLimited) || retry >= maxRetries {
+			return posts, next, err
+		}
 		logger.Errorw(
-			"reddit initializion error",
-			"err", err,
+			"rate limited, retrying",
+			"subreddit", sr.Name,
+			"reset", rateLimited.Rate.Reset,
 		)
-		return nil, err
+		// the client refuses requests until the reset
+		err = sleepContext(ctx, time.Until(rateLimited.Rate.Reset))
+		if err != nil {
+			return nil, "", err
+		}
 	}
+}
 
-	// actually get the posts
-	posts, _, err := client.Subreddit.TopPosts(
-		ctx,
-		sr.Name, &reddit.ListPostOptions{
-			ListOptions: reddit.ListOptions{
-				Limit:  sr.Count,
-				After:  "",
-				Before: "",
-			},
-			Time: sr.Timeframe,
-		})
-	return posts, err
+// grabber holds what's shared by every subreddit in a grab run
+type grabber struct {
+	Logger *logos.Logger
+	Lim    limiter
+	// HTTPClient downloads images
+	HTTPClient *http.Client
+	// DownloadTimeout bounds each attempt at an image download. 0 means no limit
+	DownloadTimeout time.Duration
+	// MaxDownloadBytes is the largest image to download. 0 means no limit
+	MaxDownloadBytes int64
+	// PathTemplate is where images are saved inside their subreddit's destination
+	PathTemplate string
+	// Sanitize is the sanitize* profile for file names
+	Sanitize string
+	// Claims holds the files being downloaded
+	Claims  *fileClaims
+	History *history
+	// Duplicates is one of the duplicates* constants
+	Duplicates string
+	Hashes     *contentIndex
+	// Perceptual is nil unless near-duplicate detection is enabled
+	Perceptual *perceptualIndex
+	// NearDuplicates is one of the nearDuplicates* constants
+	NearDuplicates string
+	// Plan is nil unless this is a dry run. Decisions are added to it instead of downloading
+	Plan *dryRunPlan
 }
 
-func grabSubreddit(logger *logos.Logger, subreddit subreddit, posts []*reddit.Post) {
+// grabSubreddit downloads posts concurrently, bounded by g.Lim, until need
+// images are counted, the posts run out, or ctx is cancelled. A post is
+// started whenever the images counted plus the posts in flight are fewer than
+// need, so a slow image doesn't hold up the others and only a gallery can
+// overshoot need. It returns the number of images counted, see grabImage
+func (g *grabber) grabSubreddit(ctx context.Context, subreddit subreddit, posts []*reddit.Post, need int) int {
+	found := 0
+	if g.Plan != nil {
+		// nothing is downloaded, so keep the posts in order for the table
+		for _, post := range posts {
+			if found >= need || ctx.Err() != nil {
+				break
+			}
+			found += g.grabPost(ctx, subreddit, post)
+		}
+		return found
+	}
 
+	done := make(chan int)
+	inFlight := 0
 	for _, post := range posts {
-		if post.NSFW {
-			logger.Errorw(
-				"Skipping NSFW post",
+		// wait for a post to finish until another one might still be needed
+		for inFlight > 0 && found+inFlight >= need {
+			found += <-done
+			inFlight--
+		}
+		if found >= need || ctx.Err() != nil {
+			break
+		}
+		inFlight++
+		go func() {
+			done <- g.grabPost(ctx, subreddit, post)
+		}()
+	}
+	for inFlight > 0 {
+		found += <-done
+		inFlight--
+	}
+	return found
+}
+
+// postsPerPage is the most posts Reddit returns in one listing
+const postsPerPage = 100
+
+// pageFetcher fetches the page of posts after the cursor, and returns the cursor for the next page.
+// The first page has an empty cursor, and an empty next cursor means there are no more pages
+type pageFetcher func(after string) ([]*reddit.Post, string, error)
+
+// grabPages fetches pages of posts and grabs them until count images are
+// found, the listing ends, or maxPages pages have been fetched. It returns
+// the number of images found and pages fetched. Posts that don't give an
+// image that counts, like NSFW posts or failed downloads, make it fetch
+// another page
+func grabPages(count int, maxPages int, fetch pageFetcher, grab func(posts []*reddit.Post, need int) int) (int, int, error) {
+	found := 0
+	after := ""
+	pages := 0
+	for pages < maxPages && found < count {
+		posts, next, err := fetch(after)
+		if err != nil {
+			return found, pages, err
+		}
+		pages++
+		found += grab(posts, count-found)
+		if next == "" {
+			break
+		}
+		after = next
+	}
+	return found, pages, nil
+}
+
+// filterFlairs returns the posts subreddit.Flairs allows
+func (g *grabber) filterFlairs(subreddit subreddit, posts []listedPost) []*reddit.Post {
+	allowed := make([]*reddit.Post, 0, len(posts))
+	for i := range posts {
+		post := &posts[i].Post
+		if subreddit.Flairs.allows(posts[i].LinkFlairText) {
+			allowed = append(allowed, post)
+			continue
+		}
+		g.Logger.Infow(
+			"Skipping post by flair",
+			"subreddit", subreddit.Name,
+			"post", post.Title,
+			"flair", posts[i].LinkFlairText,
+		)
+		g.plan(decisionSkippedFlair, subreddit, post, post.URL, "")
+		subreddit.Report.skip(decisionSkippedFlair)
+	}
+	return allowed
+}
+
+// grabPost returns the number of the post's images that count toward the
+// subreddit's count, see grabImage. Images already in history are skipped
+// one by one, so a gallery that was interrupted is finished by a later run
+func (g *grabber) grabPost(ctx context.Context, subreddit subreddit, post *reddit.Post) int {
+	if post.NSFW {
+		g.Logger.Errorw(
+			"Skipping NSFW post",
+			"subreddit", subreddit.Name,
+			"post", post.Title,
+			"url", post.URL,
+		)
+		g.plan(decisionSkippedNSFW, subreddit, post, post.URL, "")
+		subreddit.Report.skip(decisionSkippedNSFW)
+		return 0
+	}
+	candidates, err := resolvePost(ctx, subreddit.Resolvers, post)
+	if err != nil && ctx.Err() != nil {
+		// the run was cancelled, so the post wasn't really a bad URL
+		return 0
+	}
+	if err != nil {
+		g.Logger.Errorw(
+			"can't download image",
+			"subreddit", subreddit.Name,
+			"post", post.Title,
+			"url", post.URL,
+			"err", err,
+		)
+		g.plan(decisionBadURL, subreddit, post, post.URL, "")
+		subreddit.Report.skip(decisionBadURL)
+		return 0
+	}
+
+	found := 0
+	for _, candidate := range candidates {
+		if ctx.Err() != nil {
+			break
+		}
+		if g.grabImage(ctx, subreddit, post, candidate) {
+			found++
+		}
+	}
+	return found
+}
+
+// plan adds a decision to g.Plan in a dry run, and is a no-op otherwise
+func (g *grabber) plan(decision string, subreddit subreddit, post *reddit.Post, url string, filePath string) {
+	if g.Plan == nil {
+		return
+	}
+	g.Plan.add(dryRunRow{
+		Subreddit: subreddit.Name,
+		Title:     post.Title,
+		URL:       url,
+		FilePath:  filePath,
+		Decision:  decision,
+	})
+}
+
+// recordHistory adds an entry for the image, logging instead of failing if it can't be saved
+func (g *grabber) recordHistory(status string, subreddit subreddit, post *reddit.Post, url string, filePath string, sha256 string, perceptualHash string) {
+	err := g.History.add(historyEntry{
+		Time:           time.Now(),
+		Status:         status,
+		Subreddit:      subreddit.Name,
+		PostID:         post.ID,
+		Title:          post.Title,
+		URL:            url,
+		FilePath:       filePath,
+		SHA256:         sha256,
+		PerceptualHash: perceptualHash,
+	})
+	if err != nil {
+		g.Logger.Errorw(
+			"can't save history",
+			"subreddit", subreddit.Name,
+			"post", post.Title,
+			"url", url,
+			"err", err,
+		)
+	}
+}
+
+// recordReplaced adds a duplicate entry pointing at newFilePath for the
+// history entry of oldFilePath, which was removed for a larger near-duplicate.
+// Files that aren't in the history have nothing to update
+func (g *grabber) recordReplaced(oldFilePath string, newFilePath string, sha256 string, perceptualHash string) {
+	entry, ok := g.History.fileEntry(oldFilePath)
+	if !ok {
+		return
+	}
+	entry.Time = time.Now()
+	entry.Status = historyStatusDuplicate
+	entry.FilePath = newFilePath
+	entry.SHA256 = sha256
+	entry.PerceptualHash = perceptualHash
+	err := g.History.add(entry)
+	if err != nil {
+		g.Logger.Errorw(
+			"can't save history",
+			"subreddit", entry.Subreddit,
+			"post", entry.Title,
+			"url", entry.URL,
+			"err", err,
+		)
+	}
+}
+
+// grabImage returns whether the image counts toward the subreddit's count.
+// Images that were downloaded, would be in a dry run, are duplicates, or are
+// already in the destination or history count. Failed downloads and images
+// rejected by the filters, too large, with too long a path, or stopped by ctx
+// don't count, so another post is grabbed in their place
+func (g *grabber) grabImage(ctx context.Context, subreddit subreddit, post *reddit.Post, candidate imageCandidate) bool {
+	if g.History.contains(candidate.URL) {
+		g.Logger.Infow(
+			"already in history",
+			"subreddit", subreddit.Name,
+			"post", post.Title,
+			"url", candidate.URL,
+		)
+		g.plan(decisionInHistory, subreddit, post, candidate.URL, "")
+		subreddit.Report.skip(decisionInHistory)
+		return true
+	}
+
+	filePath, err := genFilePath(subreddit.Destination, g.PathTemplate, g.Sanitize, newPathFields(subreddit.Name, post, candidate))
+	if err != nil {
+		g.Logger.Errorw(
+			"genFilePath err",
+			"subreddit", subreddit.Name,
+			"post", post.Title,
+			"url", candidate.URL,
+			"err", errors.WithStack(err),
+		)
+		g.plan(decisionTooLongPath, subreddit, post, candidate.URL, "")
+		subreddit.Report.skip(decisionTooLongPath)
+		return false
+	}
+
+	if g.Plan != nil {
+		decision := existsDecision(filePath)
+		g.plan(decision, subreddit, post, candidate.URL, filePath)
+		return true
+	}
+
+	// the path template can put images in subdirectories
+	err = os.MkdirAll(filepath.Dir(filePath), 0755)
+	if err != nil {
+		g.Logger.Errorw(
+			"can't create directory",
+			"subreddit", subreddit.Name,
+			"post", post.Title,
+			"filePath", filePath,
+			"err", errors.WithStack(err),
+		)
+		subreddit.Report.fail()
+		return false
+	}
+
+	if !g.Claims.claim(filePath) {
+		g.Logger.Infow(
+			"file is being downloaded by another post",
+			"subreddit", subreddit.Name,
+			"post", post.Title,
+			"filePath", filePath,
+			"url", candidate.URL,
+		)
+		subreddit.Report.skip(decisionExists)
+		return true
+	}
+	err = g.Lim.acquire(ctx)
+	if err != nil {
+		// cancelled while waiting for a slot
+		g.Claims.release(filePath)
+		return false
+	}
+	result, err := downloadImage(ctx, g.HTTPClient, candidate.URL, filePath, subreddit.Filter, g.MaxDownloadBytes, g.DownloadTimeout)
+	g.Lim.release()
+	g.Claims.release(filePath)
+	if err != nil {
+		var rejected *imageRejectedError
+		var tooLarge *imageTooLargeError
+		counted := false
+		if ctx.Err() != nil {
+			// the partial file is kept for the next run if it can be resumed
+			reason := skipCancelled
+			if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+				reason = skipOutOfTime
+			}
+			g.Logger.Infow(
+				"download stopped",
 				"subreddit", subreddit.Name,
 				"post", post.Title,
-				"url", post.URL,
+				"url", candidate.URL,
+				"reason", reason,
 			)
-			continue
-		}
-		urlFileName, err := validateImageURL(post.URL)
-		if err != nil {
-			logger.Errorw(
-				"can't download image",
+			subreddit.Report.skip(reason)
+		} else if errors.As(err, &rejected) {
+			g.Logger.Infow(
+				"image rejected by filter",
 				"subreddit", subreddit.Name,
 				"post", post.Title,
-				"url", post.URL,
-				"err", err,
+				"url", candidate.URL,
+				"width", rejected.Width,
+				"height", rejected.Height,
+				"reason", rejected.Reason,
 			)
-			continue
+			g.recordHistory(historyStatusRejected, subreddit, post, candidate.URL, "", "", "")
+			subreddit.Report.skip(skipRejected)
+		} else if errors.As(err, &tooLarge) {
+			g.Logger.Infow(
+				"image too large",
+				"subreddit", subreddit.Name,
+				"post", post.Title,
+				"url", candidate.URL,
+				"maxBytes", tooLarge.MaxBytes,
+			)
+			g.recordHistory(historyStatusRejected, subreddit, post, candidate.URL, "", "", "")
+			subreddit.Report.skip(skipTooLarge)
+		} else if os.IsExist(errors.Cause(err)) {
+			g.Logger.Infow(
+				"file exists!",
+				"subreddit", subreddit.Name,
+				"post", post.Title,
+				"filePath", filePath,
+				"url", candidate.URL,
+			)
+			// downloaded before history was kept
+			g.recordHistory(historyStatusDownloaded, subreddit, post, candidate.URL, filePath, "", "")
+			subreddit.Report.skip(decisionExists)
+			counted = true
+		} else {
+			g.Logger.Errorw(
+				"download file error",
+				"subreddit", subreddit.Name,
+				"post", post.Title,
+				"url", candidate.URL,
+				"err", errors.WithStack(err),
+			)
+			subreddit.Report.fail()
 		}
+		return counted
+	}
 
-		filePath, err := genFilePath(subreddit.Destination, subreddit.Name, post.Title, urlFileName)
+	if g.Duplicates != duplicatesKeep {
+		existing, found, err := g.Hashes.lookupOrAdd(subreddit.Destination, result.SHA256, filePath)
 		if err != nil {
-			logger.Errorw(
-				"genFilePath err",
+			g.Logger.Errorw(
+				"can't check for duplicates",
 				"subreddit", subreddit.Name,
 				"post", post.Title,
-				"url", post.URL,
-				"err", errors.WithStack(err),
+				"filePath", filePath,
+				"err", err,
 			)
-			continue
+		} else if found {
+			err = resolveDuplicate(g.Duplicates, existing, filePath)
+			if err != nil {
+				g.Logger.Errorw(
+					"can't resolve duplicate",
+					"subreddit", subreddit.Name,
+					"post", post.Title,
+					"filePath", filePath,
+					"existing", existing,
+					"duplicates", g.Duplicates,
+					"err", err,
+				)
+				subreddit.Report.fail()
+				return false
+			}
+			g.Logger.Infow(
+				"duplicate image",
+				"subreddit", subreddit.Name,
+				"post", post.Title,
+				"filePath", filePath,
+				"existing", existing,
+				"duplicates", g.Duplicates,
+				"url", candidate.URL,
+			)
+			g.recordHistory(historyStatusDuplicate, subreddit, post, candidate.URL, existing, result.SHA256, "")
+			subreddit.Report.skip(skipDuplicate)
+			return true
 		}
-		err = downloadImage(post.URL, filePath)
-		if err != nil {
-			if os.IsExist(errors.Cause(err)) {
-				logger.Infow(
-					"file exists!",
+	}
+
+	perceptualHash := ""
+	if g.Perceptual != nil {
+		hash, keep := g.checkNearDuplicate(subreddit, post, candidate.URL, filePath, result.SHA256)
+		if !keep {
+			// a near-duplicate of an image we already have
+			return true
+		}
+		perceptualHash = hash
+	}
+
+	g.Logger.Infow(
+		"downloaded file",
+		"subreddit", subreddit.Name,
+		"post", post.Title,
+		"filePath", filePath,
+		"url", candidate.URL,
+		"bytes", result.Bytes,
+	)
+	g.recordHistory(historyStatusDownloaded, subreddit, post, candidate.URL, filePath, result.SHA256, perceptualHash)
+	subreddit.Report.downloaded(reportFile{
+		Path:   filePath,
+		URL:    candidate.URL,
+		PostID: post.ID,
+		Bytes:  result.Bytes,
+		SHA256: result.SHA256,
+	})
+	return true
+}
+
+// checkNearDuplicate compares a downloaded image to the ones in the
+// destination and history. If it looks like one of them, the new image is
+// removed, unless g.NearDuplicates is keep-larger and it's the larger image.
+// It returns the image's formatted perceptual hash and whether it was kept
+func (g *grabber) checkNearDuplicate(subreddit subreddit, post *reddit.Post, url string, filePath string, sha256 string) (string, bool) {
+	hash, size, err := hashImageFile(filePath, g.Perceptual.algorithm)
+	if err != nil {
+		g.Logger.Errorw(
+			"can't compute perceptual hash",
+			"subreddit", subreddit.Name,
+			"post", post.Title,
+			"filePath", filePath,
+			"err", err,
+		)
+		return "", true
+	}
+	match, found, err := g.Perceptual.lookupOrAdd(subreddit.Destination, hash, filePath)
+	if err != nil {
+		g.Logger.Errorw(
+			"can't check for near-duplicates",
+			"subreddit", subreddit.Name,
+			"post", post.Title,
+			"filePath", filePath,
+			"err", err,
+		)
+		return hash.String(), true
+	}
+	if !found {
+		return hash.String(), true
+	}
+
+	if g.NearDuplicates == nearDuplicatesKeepLarger {
+		// a match only in history has no file to compare to, so it's treated like reject
+		existingSize, err := imageSize(match.FilePath)
+		if err == nil && size.X*size.Y > existingSize.X*existingSize.Y {
+			err = os.Remove(match.FilePath)
+			if err != nil {
+				g.Logger.Errorw(
+					"can't remove smaller near-duplicate",
 					"subreddit", subreddit.Name,
 					"post", post.Title,
 					"filePath", filePath,
-					"url", post.URL,
+					"existing", match.FilePath,
+					"err", err,
 				)
-				continue
 			} else {
-				logger.Errorw(
-					"download file error",
+				g.Perceptual.replace(match.FilePath, hash, filePath)
+				g.recordReplaced(match.FilePath, filePath, sha256, hash.String())
+				g.Logger.Infow(
+					"replaced smaller near-duplicate",
 					"subreddit", subreddit.Name,
 					"post", post.Title,
-					"url", post.URL,
-					"err", errors.WithStack(err),
+					"filePath", filePath,
+					"existing", match.FilePath,
+					"width", size.X,
+					"height", size.Y,
+					"existingWidth", existingSize.X,
+					"existingHeight", existingSize.Y,
 				)
+				return hash.String(), true
 			}
-			continue
-
 		}
-		logger.Infow(
-			"downloaded file",
+	}
+
+	err = os.Remove(filePath)
+	if err != nil {
+		g.Logger.Errorw(
+			"can't remove near-duplicate",
 			"subreddit", subreddit.Name,
 			"post", post.Title,
 			"filePath", filePath,
-			"url", post.URL,
+			"err", errors.WithStack(err),
 		)
+		return hash.String(), true
 	}
+	g.Logger.Infow(
+		"near-duplicate image rejected",
+		"subreddit", subreddit.Name,
+		"post", post.Title,
+		"url", url,
+		"existing", match.FilePath,
+		"distance", hash.distance(match.Hash),
+	)
+	g.recordHistory(historyStatusRejected, subreddit, post, url, match.FilePath, sha256, hash.String())
+	subreddit.Report.skip(skipNearDuplicate)
+	return hash.String(), false
 }
 
 func testRedditConnection(logger *logos.Logger) error {
@@ -354,6 +1017,53 @@ func grab(ctx warg.CmdContext) error {
 	}
 
 	timeout := ctx.Flags["--timeout"].(time.Duration)
+	imgurClientID, _ := ctx.Flags["--imgur-client-id"].(string)
+	var creds redditCredentials
+	creds.ClientID, _ = ctx.Flags["--reddit-client-id"].(string)
+	creds.ClientSecret, _ = ctx.Flags["--reddit-client-secret"].(string)
+	creds.Username, _ = ctx.Flags["--reddit-username"].(string)
+	creds.Password, _ = ctx.Flags["--reddit-password"].(string)
+	creds.RefreshToken, _ = ctx.Flags["--reddit-refresh-token"].(string)
+	if err := creds.validate(); err != nil {
+		return fmt.Errorf("invalid Reddit credentials: %w", err)
+	}
+	concurrency := ctx.Flags["--concurrency"].(int)
+	if concurrency < 1 {
+		return fmt.Errorf("--concurrency must be at least 1, got %d", concurrency)
+	}
+	retry := retryPolicy{
+		MaxRetries: ctx.Flags["--max-retries"].(int),
+		BaseDelay:  ctx.Flags["--retry-base-delay"].(time.Duration),
+		MaxDelay:   ctx.Flags["--retry-max-delay"].(time.Duration),
+		// downloadImage bounds each attempt at an image download itself
+		AttemptTimeout: 0,
+	}
+	maxPages := ctx.Flags["--max-pages"].(int)
+	if maxPages < 1 {
+		return fmt.Errorf("--max-pages must be at least 1, got %d", maxPages)
+	}
+	if retry.MaxRetries < 0 {
+		return fmt.Errorf("--max-retries must be at least 0, got %d", retry.MaxRetries)
+	}
+	proxyFlag, _ := ctx.Flags["--proxy"].(string)
+	proxy, err := parseProxy(proxyFlag)
+	if err != nil {
+		return fmt.Errorf("invalid --proxy: %w", err)
+	}
+	lockWait, _ := ctx.Flags["--lock-wait"].(time.Duration)
+	maxRunTime, _ := ctx.Flags["--max-run-time"].(time.Duration)
+	if maxRunTime < 0 {
+		return fmt.Errorf("--max-run-time must be at least 0, got %s", maxRunTime)
+	}
+	maxDownloadSize := ctx.Flags["--max-download-size"].(int)
+	if maxDownloadSize < 0 {
+		return fmt.Errorf("--max-download-size must be at least 0, got %d", maxDownloadSize)
+	}
+	// Reddit requests, Imgur requests, and image downloads share these
+	settings := httpSettings{
+		Timeout: timeout,
+		Proxy:   proxy,
+	}
 
 	// retrieve types:
 	lumberJackLogger := &lumberjack.Logger{
@@ -373,61 +1083,376 @@ func grab(ctx warg.CmdContext) error {
 	zapLogger := logos.NewBBKaneZapLogger(lumberJackLogger, zap.DebugLevel, version)
 	logger := logos.New(zapLogger, color)
 	logger.LogOnPanic()
+	// flush the log however grab returns
+	defer func() {
+		_ = logger.Sync()
+	}()
+
+	globalFilter := imageFilter{
+		MinWidth:     ctx.Flags["--min-width"].(int),
+		MinHeight:    ctx.Flags["--min-height"].(int),
+		AspectRatios: nil,
+	}
+	aspectRatios, _ := ctx.Flags["--aspect-ratio"].([]string)
+	for _, a := range aspectRatios {
+		ratio, err := parseAspectRatio(a)
+		if err != nil {
+			return fmt.Errorf("invalid --aspect-ratio: %w", err)
+		}
+		globalFilter.AspectRatios = append(globalFilter.AspectRatios, ratio)
+	}
 
 	subredditInfos := ctx.Flags["--subreddit-info"].([]SubredditInfo)
 	destination := ctx.Flags["--destination"].(path.Path).MustExpand()
+	pathTemplate := ctx.Flags["--path-template"].(string)
+	if err := validatePathTemplate(pathTemplate); err != nil {
+		return fmt.Errorf("invalid --path-template: %w", err)
+	}
+	historyFilename := ctx.Flags["--history-filename"].(path.Path).MustExpand()
+	duplicates := ctx.Flags["--duplicates"].(string)
+	perceptualAlgorithm := ctx.Flags["--perceptual-hash"].(string)
+	perceptualThreshold := ctx.Flags["--perceptual-threshold"].(int)
+	nearDuplicates := ctx.Flags["--near-duplicates"].(string)
+	dryRun := ctx.Flags["--dry-run"].(bool)
+	failOn, _ := ctx.Flags["--fail-on"].([]string)
+	reportFormat := ctx.Flags["--report"].(string)
+	reportFilename := ""
+	if p, exists := ctx.Flags["--report-filename"].(path.Path); exists {
+		reportFilename = p.MustExpand()
+	}
+
+	// SIGINT or SIGTERM cancels runCtx: in-flight downloads are aborted, no
+	// new work starts, and the run is summarized
+	signalCtx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go func() {
+		<-signalCtx.Done()
+		// restore the default behavior, so a second signal kills grabbit at once
+		stop()
+	}()
+
+	// only one grab can run with a config or destination at a time. A dry
+	// run doesn't write to them, so it doesn't lock them
+	if !dryRun {
+		destinations := []string{destination}
+		for _, si := range subredditInfos {
+			if si.Destination == "" {
+				continue
+			}
+			expanded, err := path.New(si.Destination).Expand()
+			if err != nil {
+				// reported when the subreddit is grabbed
+				continue
+			}
+			destinations = append(destinations, expanded)
+		}
+		lock, err := acquireRunLock(signalCtx, runLockPaths(configPath, destinations), lockWait)
+		if err != nil {
+			logger.Errorw(
+				"can't lock run",
+				"lockWait", lockWait,
+				"err", err,
+			)
+			return fmt.Errorf("could not start run: %w", err)
+		}
+		defer func() {
+			// closing the lock files releases the locks even if unlocking fails
+			_ = lock.release()
+		}()
+	}
+
+	// behind a proxy, reddit.com may not be reachable directly
+	if proxy == nil {
+		err = testRedditConnection(logger)
+		if err != nil {
+			return fmt.Errorf("cannot connect to reddit: %w", err)
+		}
+	}
+	// --max-run-time bounds the whole run, including subreddits with a longer timebudget
+	runCtx := signalCtx
+	if maxRunTime > 0 {
+		var cancel context.CancelFunc
+		runCtx, cancel = context.WithTimeout(signalCtx, maxRunTime)
+		defer cancel()
+	}
+
+	// The limiter is shared by getPosts, the resolvers and the downloads.
+	// Subreddit goroutines only hold a slot while fetching posts, so they
+	// can't starve their own downloads
+	lim := newLimiter(concurrency)
+
+	// Reddit and Imgur requests are bounded by --timeout per attempt, so
+	// waiting between retries doesn't count against it
+	apiRetry := retry
+	apiRetry.AttemptTimeout = timeout
+
+	// Reddit requests share a transport so a rate limit pauses all of them
+	redditTransport := newRetryTransport(newHTTPTransport(settings), apiRetry)
+
+	// shared client for listings and gallery lookups
+	client, err := newRedditClient(redditTransport, creds, "")
+	if err != nil {
+		logger.Errorw(
+			"reddit initializion error",
+			"err", err,
+		)
+		return fmt.Errorf("cannot create reddit client: %w", err)
+	}
+	if creds.enabled() {
+		// creds redacts its secrets when formatted
+		logger.Infow(
+			"using authenticated reddit client",
+			"creds", creds,
+		)
+	}
+	imgurHTTPClient := newHTTPClient(settings, apiRetry)
+	resolvers := newResolverRegistry(
+		iRedditResolver{},
+		previewResolver{},
+		&galleryResolver{Client: client, Lim: lim},
+		newImgurResolver(imgurClientID, imgurHTTPClient, lim, ""),
+		directResolver{},
+	)
 
-	err = testRedditConnection(logger)
+	history, err := loadHistory(historyFilename)
 	if err != nil {
-		return fmt.Errorf("cannot connect to reddit: %w", err)
+		logger.Errorw(
+			"Can't load history",
+			"historyFilename", historyFilename,
+			"err", err,
+		)
+		return fmt.Errorf("could not load history: %w", err)
+	}
+
+	var perceptual *perceptualIndex
+	if perceptualAlgorithm != perceptualNone {
+		perceptual = newPerceptualIndex(perceptualAlgorithm, perceptualThreshold, history)
+	}
+
+	g := &grabber{
+		Logger: logger,
+		Lim:    lim,
+		// each attempt at an image download is bounded by DownloadTimeout instead of a client timeout
+		HTTPClient:       newHTTPClient(settings, retry),
+		DownloadTimeout:  timeout,
+		MaxDownloadBytes: int64(maxDownloadSize) * 1024 * 1024,
+		PathTemplate:     pathTemplate,
+		Sanitize:         ctx.Flags["--sanitize"].(string),
+		Claims:           newFileClaims(),
+		History:          history,
+		Duplicates:       duplicates,
+		Hashes:           newContentIndex(history.knownHashes()),
+		Perceptual:       perceptual,
+		NearDuplicates:   nearDuplicates,
+		Plan:             nil,
+	}
+	if dryRun {
+		g.Plan = newDryRunPlan()
 	}
 
-	timeoutCtx := context.Background()
+	report := newRunReport(dryRun)
+
+	// partial files are kept to resume interrupted downloads, unless
+	// they're so old they'll likely never be retried
+	sweeper := newPartialFileSweeper(time.Now().Add(-partialMaxAge))
+
+	var wg sync.WaitGroup
 
 	for i := 0; i < len(subredditInfos); i++ {
 
 		sr := subreddit{
 			Name:        subredditInfos[i].Subreddit,
-			Destination: destination,
+			Destination: subredditInfos[i].Destination,
+			Sort:        subredditInfos[i].Sort,
 			Timeframe:   subredditInfos[i].Timeframe,
+			Search:      subredditInfos[i].Search,
+			Flairs:      subredditInfos[i].Flairs,
 			Count:       subredditInfos[i].Count,
+			Resolvers:   resolvers.enabled(subredditInfos[i].EnableResolvers, subredditInfos[i].DisableResolvers),
+			Filter:      globalFilter.withOverrides(subredditInfos[i].Filter),
+			TimeBudget:  subredditInfos[i].TimeBudget,
+			Report:      report.addSubreddit(subredditInfos[i].Subreddit, subredditInfos[i].Sort, subredditInfos[i].Timeframe),
 		}
 
-		_, err := glib.ValidateDirectory(sr.Destination)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			sr.Report.begin()
+			defer sr.Report.end()
+
+			if signalCtx.Err() != nil {
+				return
+			}
+			// the time budget starts with the subreddit's first request, so
+			// time spent waiting for a slot behind other subreddits isn't counted
+			srCtx := runCtx
+			budgetStarted := false
+			cancelBudget := func() {}
+			defer func() {
+				cancelBudget()
+			}()
+
+			if sr.Destination == "" {
+				sr.Destination = destination
+			} else {
+				expanded, err := path.New(sr.Destination).Expand()
+				if err != nil {
+					logger.Errorw(
+						"Can't expand destination",
+						"subreddit", sr.Name,
+						"directory", sr.Destination,
+						"err", err,
+					)
+					sr.Report.failSubreddit(err)
+					return
+				}
+				sr.Destination = expanded
+			}
+
+			_, err := glib.ValidateDirectory(sr.Destination)
+			if err != nil {
+				logger.Errorw(
+					"Directory error",
+					"directory", sr.Destination,
+					"err", err,
+				)
+				sr.Report.failSubreddit(err)
+				return
+			}
+
+			if !dryRun {
+				removed, err := sweeper.sweep(sr.Destination)
+				if err != nil {
+					// not fatal, leftovers don't stop new downloads
+					logger.Errorw(
+						"can't remove old partial files",
+						"directory", sr.Destination,
+						"err", err,
+					)
+				}
+				for _, r := range removed {
+					logger.Infow(
+						"removed old partial file from interrupted download",
+						"filePath", r,
+					)
+				}
+			}
+
+			fetch := func(after string) ([]*reddit.Post, string, error) {
+				err := lim.acquire(srCtx)
+				if err != nil {
+					return nil, "", err
+				}
+				defer lim.release()
+				if sr.TimeBudget > 0 && !budgetStarted {
+					budgetStarted = true
+					srCtx, cancelBudget = context.WithTimeout(runCtx, sr.TimeBudget)
+				}
+				posts, next, err := getPosts(srCtx, client, retry.MaxRetries, logger, sr, after)
+				if err != nil {
+					return nil, "", err
+				}
+				sr.Report.fetched(len(posts))
+				if len(posts) == 0 && after == "" {
+					logger.Errorw(
+						"posts list is empty",
+						"subreddit", sr.Name,
+					)
+				}
+				return g.filterFlairs(sr, posts), next, nil
+			}
+			grabPosts := func(posts []*reddit.Post, need int) int {
+				return g.grabSubreddit(srCtx, sr, posts, need)
+			}
+
+			found, pages, err := grabPages(sr.Count, maxPages, fetch, grabPosts)
+			if signalCtx.Err() != nil {
+				logger.Infow(
+					"subreddit cancelled",
+					"subreddit", sr.Name,
+					"found", found,
+				)
+				return
+			}
+			if srCtx.Err() != nil && found < sr.Count {
+				// remaining posts are skipped, but reported
+				logger.Errorw(
+					"subreddit ran out of time",
+					"subreddit", sr.Name,
+					"timeBudget", sr.TimeBudget,
+					"count", sr.Count,
+					"found", found,
+				)
+				sr.Report.outOfTime(sr.Count - found)
+				return
+			}
+			if err != nil {
+				// not fatal, we can continue with other subreddits
+				logger.Errorw(
+					"Can't use subreddit",
+					"subreddit", sr.Name,
+					"err", errors.WithStack(err),
+				)
+				sr.Report.failSubreddit(err)
+				return
+			}
+			if found < sr.Count {
+				logger.Infow(
+					"found fewer images than count",
+					"subreddit", sr.Name,
+					"count", sr.Count,
+					"found", found,
+					"pages", pages,
+				)
+			}
+		}()
+	}
+	wg.Wait()
+	report.Cancelled = signalCtx.Err() != nil
+	report.OutOfTime = !report.Cancelled && errors.Is(runCtx.Err(), context.DeadlineExceeded)
+	report.finish()
+
+	if report.stoppedEarly() {
+		logger.Errorw(
+			"run stopped early",
+			"cancelled", report.Cancelled,
+			"outOfTime", report.OutOfTime,
+			"maxRunTime", maxRunTime,
+			"downloaded", report.Downloaded,
+			"failed", report.Failed,
+		)
+		err = report.writeSummary(os.Stderr)
 		if err != nil {
-			logger.Errorw(
-				"Directory error",
-				"directory", sr.Destination,
-				"err", err,
-			)
-			continue
+			return fmt.Errorf("could not print summary: %w", err)
 		}
+	}
 
-		posts, err := getTopPosts(timeoutCtx, timeout, logger, sr, "")
-		if err != nil {
-			// not fatal, we can continue with other subreddits
-			logger.Errorw(
-				"Can't use subreddit",
-				"subreddit", sr.Name,
-				"err", errors.WithStack(err),
-			)
-			continue
+	if g.Plan != nil {
+		// keep stdout parseable when the JSON report is written to it
+		planOut := os.Stdout
+		if reportFormat == reportJSON && reportFilename == "" {
+			planOut = os.Stderr
 		}
-		if len(posts) == 0 {
-			logger.Errorw(
-				"posts list is empty",
-				"subreddit", sr.Name,
-			)
-			continue
+		err = g.Plan.print(planOut)
+		if err != nil {
+			return fmt.Errorf("could not print dry run: %w", err)
 		}
-
-		grabSubreddit(logger, sr, posts)
 	}
 
-	err = logger.Sync()
-	if err != nil {
-		return fmt.Errorf("could not sync logger: %w", err)
+	if reportFormat == reportJSON {
+		err = writeReportFile(report, reportFilename)
+		if err != nil {
+			return fmt.Errorf("could not write report: %w", err)
+		}
 	}
 
-	return nil
+	logger.Infow(
+		"run finished",
+		"outcome", report.Outcome,
+		"downloaded", report.Downloaded,
+		"skipped", report.Skipped,
+		"failed", report.Failed,
+	)
+
+	return checkFailOn(report, failOn)
 }
@@ -1,12 +1,24 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"fmt"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"path/filepath"
 	"testing"
+	"time"
 
+	"github.com/pkg/errors"
 	"github.com/stretchr/testify/require"
+	"github.com/vartanbeno/go-reddit/v2/reddit"
+	"go.bbkane.com/logos"
 	"go.bbkane.com/warg"
+	"go.uber.org/zap"
+	lumberjack "gopkg.in/natefinch/lumberjack.v2"
 )
 
 func TestGrabE2E(t *testing.T) {
@@ -32,6 +44,7 @@ func TestGrabE2E(t *testing.T) {
 		// hack to not use a config
 		"--config", "not-there",
 		"--log-filename", filepath.Join(dir, "log.jsonl"),
+		"--history-filename", filepath.Join(dir, "history.jsonl"),
 	}
 
 	parsed, err := app.Parse(
@@ -101,3 +114,353 @@ func TestCheckConfigVersionKey(t *testing.T) {
 		})
 	}
 }
+
+func TestGrabPages(t *testing.T) {
+	t.Parallel()
+
+	// pages of 3 posts. Every other post has a downloadable image
+	page := func(after string) ([]*reddit.Post, string, error) {
+		n := 0
+		if after != "" {
+			_, err := fmt.Sscanf(after, "t3_%d", &n)
+			if err != nil {
+				return nil, "", errors.WithStack(err)
+			}
+		}
+		posts := []*reddit.Post{}
+		for i := n; i < n+3; i++ {
+			var post reddit.Post
+			post.ID = fmt.Sprint(i)
+			post.NSFW = i%2 == 1
+			posts = append(posts, &post)
+		}
+		return posts, fmt.Sprintf("t3_%d", n+3), nil
+	}
+
+	tests := []struct {
+		name      string
+		count     int
+		maxPages  int
+		fetch     pageFetcher
+		wantFound int
+		wantPages int
+		wantErr   bool
+	}{
+		{
+			name:      "first page is enough",
+			count:     2,
+			maxPages:  5,
+			fetch:     page,
+			wantFound: 2,
+			wantPages: 1,
+			wantErr:   false,
+		},
+		{
+			name:      "pages past filtered posts",
+			count:     4,
+			maxPages:  5,
+			fetch:     page,
+			wantFound: 4,
+			wantPages: 3,
+			wantErr:   false,
+		},
+		{
+			name:      "stops at max pages",
+			count:     10,
+			maxPages:  2,
+			fetch:     page,
+			wantFound: 3,
+			wantPages: 2,
+			wantErr:   false,
+		},
+		{
+			name:     "stops at end of listing",
+			count:    10,
+			maxPages: 5,
+			fetch: func(after string) ([]*reddit.Post, string, error) {
+				posts, _, err := page(after)
+				return posts, "", err
+			},
+			wantFound: 2,
+			wantPages: 1,
+			wantErr:   false,
+		},
+		{
+			name:     "fetch error",
+			count:    10,
+			maxPages: 5,
+			fetch: func(after string) ([]*reddit.Post, string, error) {
+				return nil, "", errors.New("subreddit not found")
+			},
+			wantFound: 0,
+			wantPages: 0,
+			wantErr:   true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			grabbed := []string{}
+			grab := func(posts []*reddit.Post, need int) int {
+				found := 0
+				for _, post := range posts {
+					if found == need {
+						break
+					}
+					grabbed = append(grabbed, post.ID)
+					if !post.NSFW {
+						found++
+					}
+				}
+				return found
+			}
+
+			found, pages, err := grabPages(tt.count, tt.maxPages, tt.fetch, grab)
+			if tt.wantErr {
+				require.Error(t, err)
+			} else {
+				require.NoError(t, err)
+			}
+			require.Equal(t, tt.wantFound, found)
+			require.Equal(t, tt.wantPages, pages)
+			// posts are grabbed in listing order without skipping any
+			for i, id := range grabbed {
+				require.Equal(t, fmt.Sprint(i), id)
+			}
+		})
+	}
+}
+
+func TestLimiter_acquire(t *testing.T) {
+	t.Parallel()
+
+	lim := newLimiter(1)
+	require.NoError(t, lim.acquire(t.Context()))
+
+	// the only slot is taken, so this waits until ctx times out
+	ctx, cancel := context.WithTimeout(t.Context(), 50*time.Millisecond)
+	defer cancel()
+	err := lim.acquire(ctx)
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+
+	lim.release()
+	require.NoError(t, lim.acquire(t.Context()))
+}
+
+// testLogger builds a logger like grab does, writing to a temporary file
+func testLogger(t *testing.T) *logos.Logger {
+	t.Helper()
+	color, err := warg.ConditionallyEnableColor(warg.PassedFlags{"--color": "false"}, os.Stdout)
+	require.NoError(t, err)
+	lumberJackLogger := &lumberjack.Logger{
+		Filename:   filepath.Join(t.TempDir(), "grabbit.jsonl"),
+		MaxAge:     0,
+		MaxBackups: 0,
+		MaxSize:    0,
+		LocalTime:  true,
+		Compress:   false,
+	}
+	t.Cleanup(func() {
+		_ = lumberJackLogger.Close()
+	})
+	return logos.New(logos.NewBBKaneZapLogger(lumberJackLogger, zap.DebugLevel, version), color)
+}
+
+// stubResolver resolves every post to the same candidates
+type stubResolver struct {
+	Candidates []imageCandidate
+}
+
+func (r stubResolver) Name() string {
+	return "stub"
+}
+
+func (r stubResolver) Matches(post *reddit.Post) bool {
+	return true
+}
+
+func (r stubResolver) Resolve(ctx context.Context, post *reddit.Post) ([]imageCandidate, error) {
+	return r.Candidates, nil
+}
+
+// newTestGrabber returns a grabber that downloads with client, keeping its
+// history in a temporary directory
+func newTestGrabber(t *testing.T, client *http.Client) *grabber {
+	t.Helper()
+	h, err := loadHistory(filepath.Join(t.TempDir(), "history.jsonl"))
+	require.NoError(t, err)
+	return &grabber{
+		Logger:           testLogger(t),
+		Lim:              newLimiter(2),
+		HTTPClient:       client,
+		DownloadTimeout:  0,
+		MaxDownloadBytes: 0,
+		PathTemplate:     "{id}_{name}.{ext}",
+		Sanitize:         sanitizePosix,
+		Claims:           newFileClaims(),
+		History:          h,
+		Duplicates:       duplicatesKeep,
+		Hashes:           newContentIndex(h.knownHashes()),
+		Perceptual:       nil,
+		NearDuplicates:   nearDuplicatesReject,
+		Plan:             nil,
+	}
+}
+
+// newTestSubreddit returns a subreddit saving to a temporary directory, resolving posts with resolver
+func newTestSubreddit(t *testing.T, resolver Resolver) subreddit {
+	t.Helper()
+	var noFilter imageFilter
+	var noFlairs flairFilter
+	return subreddit{
+		Name:        "wallpapers",
+		Destination: t.TempDir(),
+		Sort:        sortTop,
+		Timeframe:   "week",
+		Search:      "",
+		Flairs:      noFlairs,
+		Count:       5,
+		Resolvers:   []Resolver{resolver},
+		Filter:      noFilter,
+		TimeBudget:  0,
+		Report:      newRunReport(false).addSubreddit("wallpapers", sortTop, "week"),
+	}
+}
+
+func TestGrabPost_galleryPartlyInHistory(t *testing.T) {
+	t.Parallel()
+
+	content := largeImage(t)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write(content)
+	}))
+	defer server.Close()
+
+	var candidates []imageCandidate
+	for _, name := range []string{"a", "b", "c"} {
+		candidates = append(candidates, newImageCandidate(server.URL+"/"+name+".png", name+".png"))
+	}
+	g := newTestGrabber(t, server.Client())
+	sr := newTestSubreddit(t, stubResolver{Candidates: candidates})
+	post := &reddit.Post{ID: "gallery1", Title: "Mountains", URL: "https://www.reddit.com/gallery/gallery1"}
+
+	// an earlier run was interrupted after the first image
+	require.NoError(t, g.History.add(historyEntry{
+		Time:           time.Now(),
+		Status:         historyStatusDownloaded,
+		Subreddit:      sr.Name,
+		PostID:         post.ID,
+		Title:          post.Title,
+		URL:            candidates[0].URL,
+		FilePath:       filepath.Join(sr.Destination, "gallery1_a.png"),
+		SHA256:         "",
+		PerceptualHash: "",
+	}))
+
+	counted := g.grabPost(t.Context(), sr, post)
+	require.Equal(t, 3, counted)
+	require.Equal(t, 2, sr.Report.Downloaded)
+	require.Equal(t, map[string]int{decisionInHistory: 1}, sr.Report.Skipped)
+	require.NoFileExists(t, filepath.Join(sr.Destination, "gallery1_a.png"))
+	require.FileExists(t, filepath.Join(sr.Destination, "gallery1_b.png"))
+	require.FileExists(t, filepath.Join(sr.Destination, "gallery1_c.png"))
+}
+
+func TestGrabSubreddit_slowImage(t *testing.T) {
+	t.Parallel()
+
+	content := largeImage(t)
+	fastRequested := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/slow.png":
+			// only finish once the next post started while this one was in flight
+			select {
+			case <-fastRequested:
+			case <-time.After(5 * time.Second):
+				http.Error(w, "fast.png wasn't requested while slow.png was in flight", http.StatusInternalServerError)
+				return
+			}
+		case "/missing.png":
+			http.NotFound(w, r)
+			return
+		case "/fast.png":
+			close(fastRequested)
+		}
+		_, _ = w.Write(content)
+	}))
+	defer server.Close()
+
+	g := newTestGrabber(t, server.Client())
+	sr := newTestSubreddit(t, directResolver{})
+	var posts []*reddit.Post
+	for _, name := range []string{"slow", "missing", "fast", "extra"} {
+		posts = append(posts, &reddit.Post{ID: name, Title: name, URL: server.URL + "/" + name + ".png"})
+	}
+
+	// the failed download doesn't count, so fast.png takes its place
+	found := g.grabSubreddit(t.Context(), sr, posts, 2)
+	require.Equal(t, 2, found)
+	require.Equal(t, 2, sr.Report.Downloaded)
+	require.Equal(t, 1, sr.Report.Failed)
+	require.FileExists(t, filepath.Join(sr.Destination, "slow_slow.png"))
+	require.FileExists(t, filepath.Join(sr.Destination, "fast_fast.png"))
+	require.NoFileExists(t, filepath.Join(sr.Destination, "extra_extra.png"))
+}
+
+func TestGrabPost_replaceSmallerNearDuplicate(t *testing.T) {
+	t.Parallel()
+
+	var large bytes.Buffer
+	require.NoError(t, png.Encode(&large, testLandscape(960, 540, false)))
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write(large.Bytes())
+	}))
+	defer server.Close()
+
+	candidate := newImageCandidate(server.URL+"/large.png", "large.png")
+	g := newTestGrabber(t, server.Client())
+	g.NearDuplicates = nearDuplicatesKeepLarger
+	sr := newTestSubreddit(t, stubResolver{Candidates: []imageCandidate{candidate}})
+
+	// an earlier run downloaded a smaller version
+	small := filepath.Join(sr.Destination, "old_small.png")
+	writePNG(t, small, testLandscape(320, 180, false))
+	smallHash, _, err := hashImageFile(small, perceptualDHash)
+	require.NoError(t, err)
+	require.NoError(t, g.History.add(historyEntry{
+		Time:           time.Now(),
+		Status:         historyStatusDownloaded,
+		Subreddit:      sr.Name,
+		PostID:         "old",
+		Title:          "Small mountains",
+		URL:            "https://i.redd.it/small.png",
+		FilePath:       small,
+		SHA256:         "aa",
+		PerceptualHash: smallHash.String(),
+	}))
+	g.Perceptual = newPerceptualIndex(perceptualDHash, 5, g.History)
+
+	post := &reddit.Post{ID: "new", Title: "Mountains", URL: candidate.URL}
+	require.Equal(t, 1, g.grabPost(t.Context(), sr, post))
+	kept := filepath.Join(sr.Destination, "new_large.png")
+	require.FileExists(t, kept)
+	require.NoFileExists(t, small)
+
+	// the old image's entry now points at the kept file
+	h, err := loadHistory(g.History.filename)
+	require.NoError(t, err)
+	require.Len(t, h.entries, 3)
+	replaced := h.entries[1]
+	require.Equal(t, historyStatusDuplicate, replaced.Status)
+	require.Equal(t, "https://i.redd.it/small.png", replaced.URL)
+	require.Equal(t, "old", replaced.PostID)
+	require.Equal(t, kept, replaced.FilePath)
+	require.Equal(t, sha256Hex(large.Bytes()), replaced.SHA256)
+
+	known := h.knownHashes()
+	require.NotContains(t, known, small)
+	require.Equal(t, sha256Hex(large.Bytes()), known[kept].SHA256)
+}
@@ -0,0 +1,300 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.bbkane.com/warg"
+	"go.bbkane.com/warg/path"
+)
+
+const (
+	historyStatusDownloaded = "downloaded"
+	historyStatusRejected   = "rejected"
+	// historyStatusDuplicate images matched an existing file's content, or
+	// were replaced by a larger near-duplicate. Their FilePath is the file kept
+	historyStatusDuplicate = "duplicate"
+)
+
+// historyEntry records an image grab handled so it's skipped on later runs,
+// even if the file is moved or deleted
+type historyEntry struct {
+	Time      time.Time `json:"time"`
+	Status    string    `json:"status"`
+	Subreddit string    `json:"subreddit"`
+	PostID    string    `json:"post_id"`
+	Title     string    `json:"title"`
+	URL       string    `json:"url"`
+	FilePath  string    `json:"file_path"`
+	SHA256    string    `json:"sha256,omitempty"`
+	// PerceptualHash is formatted as "<algorithm>:<hex>"
+	PerceptualHash string `json:"perceptual_hash,omitempty"`
+}
+
+// history is an append-only JSONL file of historyEntry, keyed by post ID and image URL
+type history struct {
+	mu       sync.Mutex
+	filename string
+	entries  []historyEntry
+	urls     map[string]bool
+}
+
+// loadHistory reads the history file. A missing file is an empty history
+func loadHistory(filename string) (*history, error) {
+	h := &history{
+		mu:       sync.Mutex{},
+		filename: filename,
+		entries:  nil,
+		urls:     make(map[string]bool),
+	}
+
+	file, err := os.Open(filename)
+	if errors.Is(err, os.ErrNotExist) {
+		return h, nil
+	}
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		line := scanner.Bytes()
+		if len(line) == 0 {
+			continue
+		}
+		var entry historyEntry
+		err := json.Unmarshal(line, &entry)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid history entry: %s:%d", filename, lineNum)
+		}
+		h.entries = append(h.entries, entry)
+		h.index(entry)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return h, nil
+}
+
+// index adds an entry to the lookup maps. Call it with h.mu held
+func (h *history) index(entry historyEntry) {
+	h.urls[entry.URL] = true
+}
+
+// contains reports whether an image URL has already been handled
+func (h *history) contains(url string) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.urls[url]
+}
+
+// fileEntry returns the latest downloaded entry whose file is filePath
+func (h *history) fileEntry(filePath string) (historyEntry, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for i := len(h.entries) - 1; i >= 0; i-- {
+		if h.entries[i].FilePath == filePath && h.entries[i].Status == historyStatusDownloaded {
+			return h.entries[i], true
+		}
+	}
+	return historyEntry{}, false
+}
+
+// knownHashes returns the hashes of the files in the history. The latest
+// entry of a URL says where its file is now, so replaced files aren't known
+func (h *history) knownHashes() map[string]knownHash {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	latest := make(map[string]int, len(h.entries))
+	for i, entry := range h.entries {
+		latest[entry.URL] = i
+	}
+	known := make(map[string]knownHash)
+	for i, entry := range h.entries {
+		if latest[entry.URL] != i {
+			continue
+		}
+		if entry.SHA256 != "" && entry.FilePath != "" {
+			known[entry.FilePath] = knownHash{SHA256: entry.SHA256, Time: entry.Time}
+		}
+	}
+	return known
+}
+
+// add appends an entry to the history file
+func (h *history) add(entry historyEntry) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	err = os.MkdirAll(filepath.Dir(h.filename), 0755)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	file, err := os.OpenFile(h.filename, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer file.Close()
+
+	_, err = file.Write(append(line, '\n'))
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	h.entries = append(h.entries, entry)
+	h.index(entry)
+	return nil
+}
+
+// forget removes the entries matching forget and rewrites the history file.
+// It returns the number of entries removed
+func (h *history) forget(forget func(historyEntry) bool) (int, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	kept := []historyEntry{}
+	for _, entry := range h.entries {
+		if !forget(entry) {
+			kept = append(kept, entry)
+		}
+	}
+	removed := len(h.entries) - len(kept)
+	if removed == 0 {
+		return 0, nil
+	}
+
+	// write to a temp file and rename so a crash can't lose the history
+	tmp, err := os.CreateTemp(filepath.Dir(h.filename), filepath.Base(h.filename)+".*.tmp")
+	if err != nil {
+		return 0, errors.WithStack(err)
+	}
+	defer os.Remove(tmp.Name())
+
+	w := bufio.NewWriter(tmp)
+	for _, entry := range kept {
+		line, err := json.Marshal(entry)
+		if err != nil {
+			tmp.Close()
+			return 0, errors.WithStack(err)
+		}
+		_, _ = w.Write(append(line, '\n'))
+	}
+	err = w.Flush()
+	if err != nil {
+		tmp.Close()
+		return 0, errors.WithStack(err)
+	}
+	err = tmp.Close()
+	if err != nil {
+		return 0, errors.WithStack(err)
+	}
+	err = os.Rename(tmp.Name(), h.filename)
+	if err != nil {
+		return 0, errors.WithStack(err)
+	}
+
+	h.entries = kept
+	h.urls = make(map[string]bool)
+	for _, entry := range kept {
+		h.index(entry)
+	}
+	return removed, nil
+}
+
+// matches reports whether query is a case insensitive substring of any of the entry's text fields
+func (e historyEntry) matches(query string) bool {
+	query = strings.ToLower(query)
+	for _, field := range []string{e.Status, e.Subreddit, e.PostID, e.Title, e.URL, e.FilePath} {
+		if strings.Contains(strings.ToLower(field), query) {
+			return true
+		}
+	}
+	return false
+}
+
+func printHistoryEntries(entries []historyEntry) error {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "TIME\tSTATUS\tSUBREDDIT\tPOST ID\tTITLE\tURL\tFILE PATH")
+	for _, e := range entries {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n", e.Time.Format(time.RFC3339), e.Status, e.Subreddit, e.PostID, e.Title, e.URL, e.FilePath)
+	}
+	return w.Flush()
+}
+
+func historyFromFlags(ctx warg.CmdContext) (*history, error) {
+	filename := ctx.Flags["--history-filename"].(path.Path).MustExpand()
+	h, err := loadHistory(filename)
+	if err != nil {
+		return nil, fmt.Errorf("could not load history: %w", err)
+	}
+	return h, nil
+}
+
+func historyList(ctx warg.CmdContext) error {
+	h, err := historyFromFlags(ctx)
+	if err != nil {
+		return err
+	}
+	return printHistoryEntries(h.entries)
+}
+
+func historySearch(ctx warg.CmdContext) error {
+	h, err := historyFromFlags(ctx)
+	if err != nil {
+		return err
+	}
+	query := ctx.Flags["--query"].(string)
+	found := []historyEntry{}
+	for _, entry := range h.entries {
+		if entry.matches(query) {
+			found = append(found, entry)
+		}
+	}
+	return printHistoryEntries(found)
+}
+
+func historyForget(ctx warg.CmdContext) error {
+	h, err := historyFromFlags(ctx)
+	if err != nil {
+		return err
+	}
+	postIDs, _ := ctx.Flags["--post-id"].([]string)
+	urls, _ := ctx.Flags["--url"].([]string)
+	if len(postIDs) == 0 && len(urls) == 0 {
+		return errors.New("must pass --post-id or --url")
+	}
+
+	forgetPostIDs := make(map[string]bool)
+	for _, id := range postIDs {
+		forgetPostIDs[id] = true
+	}
+	forgetURLs := make(map[string]bool)
+	for _, url := range urls {
+		forgetURLs[url] = true
+	}
+
+	removed, err := h.forget(func(e historyEntry) bool {
+		return forgetPostIDs[e.PostID] || forgetURLs[e.URL]
+	})
+	if err != nil {
+		return fmt.Errorf("could not forget history entries: %w", err)
+	}
+	fmt.Printf("Forgot %d entries\n", removed)
+	return nil
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestHistory(t *testing.T) {
+	t.Parallel()
+
+	filename := filepath.Join(t.TempDir(), "history.jsonl")
+
+	h, err := loadHistory(filename)
+	require.NoError(t, err)
+	require.False(t, h.contains("https://i.redd.it/a.jpg"))
+
+	entry := func(postID string, url string) historyEntry {
+		return historyEntry{
+			Time:           time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC),
+			Status:         historyStatusDownloaded,
+			Subreddit:      "wallpapers",
+			PostID:         postID,
+			Title:          "title",
+			URL:            url,
+			FilePath:       "/tmp/wallpapers_title_a.jpg",
+			SHA256:         "",
+			PerceptualHash: "",
+		}
+	}
+	require.NoError(t, h.add(entry("a", "https://i.redd.it/a.jpg")))
+	require.NoError(t, h.add(entry("b", "https://i.redd.it/b.jpg")))
+	require.True(t, h.contains("https://i.redd.it/a.jpg"))
+
+	// the entries survive a reload
+	h, err = loadHistory(filename)
+	require.NoError(t, err)
+	require.Equal(t, []historyEntry{entry("a", "https://i.redd.it/a.jpg"), entry("b", "https://i.redd.it/b.jpg")}, h.entries)
+
+	removed, err := h.forget(func(e historyEntry) bool { return e.PostID == "a" })
+	require.NoError(t, err)
+	require.Equal(t, 1, removed)
+	require.False(t, h.contains("https://i.redd.it/a.jpg"))
+
+	h, err = loadHistory(filename)
+	require.NoError(t, err)
+	require.Equal(t, []historyEntry{entry("b", "https://i.redd.it/b.jpg")}, h.entries)
+
+	require.NoError(t, os.WriteFile(filename, []byte("not json\n"), 0600))
+	_, err = loadHistory(filename)
+	require.Error(t, err)
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/url"
+	"runtime"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// httpSettings are shared by the transports for Reddit, Imgur, and image downloads
+type httpSettings struct {
+	// Timeout bounds connecting to a server and waiting for its response headers. 0 means no limit
+	Timeout time.Duration
+	// Proxy is used for all requests. If nil, the HTTP_PROXY, HTTPS_PROXY and
+	// NO_PROXY environment variables are used instead
+	Proxy *url.URL
+}
+
+// parseProxy parses a --proxy URL. An empty string means the environment's proxy
+func parseProxy(proxy string) (*url.URL, error) {
+	if proxy == "" {
+		return nil, nil
+	}
+	proxyURL, err := url.Parse(proxy)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if proxyURL.Scheme == "" || proxyURL.Host == "" {
+		return nil, errors.Errorf("proxy must be a URL like http://host:port, got %#v", proxy)
+	}
+	return proxyURL, nil
+}
+
+// userAgent identifies grabbit to Reddit and image hosts
+func userAgent() string {
+	return runtime.GOOS + ":" + "grabbit" + ":" + version + " (go.bbkane.com/grabbit)"
+}
+
+// newHTTPTransport builds the transport used for Reddit API requests and image downloads
+func newHTTPTransport(settings httpSettings) *http.Transport {
+	var dialer net.Dialer
+	dialer.Timeout = settings.Timeout
+	dialer.KeepAlive = 30 * time.Second
+
+	var transport http.Transport
+	transport.Proxy = http.ProxyFromEnvironment
+	if settings.Proxy != nil {
+		transport.Proxy = http.ProxyURL(settings.Proxy)
+	}
+	transport.DialContext = dialer.DialContext
+	// https://www.reddit.com/r/redditdev/comments/uncu00/comment/i8gyfmx/
+	transport.ForceAttemptHTTP2 = true
+	transport.MaxIdleConns = 100
+	transport.IdleConnTimeout = 90 * time.Second
+	transport.TLSHandshakeTimeout = 10 * time.Second
+	transport.ExpectContinueTimeout = 1 * time.Second
+	transport.ResponseHeaderTimeout = settings.Timeout
+	return &transport
+}
+
+// newHTTPClient builds a client that sets grabbit's User-Agent and retries
+// failed requests with policy. Requests should carry a context to be
+// cancelled or time out
+func newHTTPClient(settings httpSettings, policy retryPolicy) *http.Client {
+	return &http.Client{
+		Timeout: 0,
+		Transport: userAgentTransport{
+			UserAgent: userAgent(),
+			Base:      newRetryTransport(newHTTPTransport(settings), policy),
+		},
+		CheckRedirect: nil,
+		Jar:           nil,
+	}
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/vartanbeno/go-reddit/v2/reddit"
+)
+
+// imgurResolver turns imgur.com page and album URLs into direct image URLs
+type imgurResolver struct {
+	// ClientID is an Imgur API client ID. Without it, single image pages are
+	// still resolved, but albums can't be
+	ClientID string
+	// BaseURL is the Imgur API URL. Override it for tests
+	BaseURL    string
+	HTTPClient *http.Client
+	Lim        limiter
+}
+
+func newImgurResolver(clientID string, client *http.Client, lim limiter, baseURL string) *imgurResolver {
+	if baseURL == "" {
+		baseURL = "https://api.imgur.com"
+	}
+	return &imgurResolver{
+		ClientID:   clientID,
+		BaseURL:    baseURL,
+		HTTPClient: client,
+		Lim:        lim,
+	}
+}
+
+func (r *imgurResolver) Name() string {
+	return resolverImgur
+}
+
+func (r *imgurResolver) Matches(post *reddit.Post) bool {
+	_, _, ok := parseImgurURL(post.URL)
+	return ok
+}
+
+// Kinds of Imgur page URLs
+const (
+	imgurKindImage = "image"
+	imgurKindAlbum = "album"
+	// imgurKindGallery is /gallery/<id>, used for both albums and single images
+	imgurKindGallery = "gallery"
+)
+
+// imgurReservedPaths are imgur.com pages whose names look like IDs
+// nolint: gochecknoglobals // readonly map used for validation
+var imgurReservedPaths = map[string]bool{
+	"about":    true,
+	"account":  true,
+	"apps":     true,
+	"blog":     true,
+	"gallery":  true,
+	"privacy":  true,
+	"random":   true,
+	"register": true,
+	"rules":    true,
+	"search":   true,
+	"signin":   true,
+	"upload":   true,
+	"user":     true,
+}
+
+// isImgurID reports whether id looks like an Imgur ID: 5 to 7 letters and digits
+func isImgurID(id string) bool {
+	if len(id) < 5 || len(id) > 7 || imgurReservedPaths[strings.ToLower(id)] {
+		return false
+	}
+	for _, c := range id {
+		if !('a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9') {
+			return false
+		}
+	}
+	return true
+}
+
+func (r *imgurResolver) Resolve(ctx context.Context, post *reddit.Post) ([]imageCandidate, error) {
+	err := r.Lim.acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Lim.release()
+	return r.resolveURL(ctx, post.URL)
+}
+
+// parseImgurURL returns the Imgur ID of a page URL and its imgurKind* constant
+// parseImgurURL("https://imgur.com/a/abcde") -> "abcde", imgurKindAlbum, true
+// parseImgurURL("https://imgur.com/abcde") -> "abcde", imgurKindImage, true
+func parseImgurURL(fullURL string) (string, string, bool) {
+	imgurURL, err := url.Parse(fullURL)
+	if err != nil {
+		return "", "", false
+	}
+	switch strings.ToLower(imgurURL.Hostname()) {
+	case "imgur.com", "www.imgur.com", "m.imgur.com":
+	default:
+		return "", "", false
+	}
+
+	segments := strings.Split(strings.Trim(imgurURL.Path, "/"), "/")
+	var id string
+	var kind string
+	switch {
+	case len(segments) == 1:
+		id = segments[0]
+		kind = imgurKindImage
+	case len(segments) == 2 && segments[0] == "a":
+		id = segments[1]
+		kind = imgurKindAlbum
+	case len(segments) == 2 && segments[0] == "gallery":
+		id = segments[1]
+		kind = imgurKindGallery
+	default:
+		return "", "", false
+	}
+	// newer URLs have a title slug before the ID: /a/some-title-abc
+	if i := strings.LastIndex(id, "-"); i != -1 {
+		id = id[i+1:]
+	}
+	// drop extensions from URLs like imgur.com/abc.jpg
+	id = strings.TrimSuffix(id, path.Ext(id))
+	if !isImgurID(id) {
+		return "", "", false
+	}
+	return id, kind, true
+}
+
+// imgurStatusError is an unexpected Imgur API response status
+type imgurStatusError struct {
+	APIPath    string
+	StatusCode int
+	Status     string
+}
+
+func (e *imgurStatusError) Error() string {
+	return fmt.Sprintf("unexpected Imgur API status: %#v: %#v", e.APIPath, e.Status)
+}
+
+// imgurImage is an image from an Imgur API response
+type imgurImage struct {
+	Type string `json:"type"`
+	Link string `json:"link"`
+}
+
+// resolveURL returns the images behind an Imgur page or album URL
+func (r *imgurResolver) resolveURL(ctx context.Context, fullURL string) ([]imageCandidate, error) {
+	id, kind, ok := parseImgurURL(fullURL)
+	if !ok {
+		return nil, errors.Errorf("not an Imgur page URL: %#v", fullURL)
+	}
+
+	if kind == imgurKindImage {
+		return r.resolveImage(ctx, id)
+	}
+
+	if r.ClientID == "" {
+		return nil, errors.Errorf("an Imgur client ID is required to download albums: %#v", fullURL)
+	}
+	var images []imgurImage
+	err := r.get(ctx, "/3/album/"+id+"/images", &images)
+	var status *imgurStatusError
+	if kind == imgurKindGallery && errors.As(err, &status) && status.StatusCode == http.StatusNotFound {
+		// the gallery post is a single image
+		return r.resolveImage(ctx, id)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return imgurCandidates(images, true)
+}
+
+// resolveImage returns the image with an Imgur ID
+func (r *imgurResolver) resolveImage(ctx context.Context, id string) ([]imageCandidate, error) {
+	if r.ClientID == "" {
+		// Imgur serves the image for a page ID regardless of its real extension
+		return []imageCandidate{{URL: "https://i.imgur.com/" + id + ".jpg", Name: id, Ext: ".jpg"}}, nil
+	}
+	var image imgurImage
+	err := r.get(ctx, "/3/image/"+id, &image)
+	if err != nil {
+		return nil, err
+	}
+	return imgurCandidates([]imgurImage{image}, false)
+}
+
+// get calls the Imgur API and decodes the response's data field into v
+func (r *imgurResolver) get(ctx context.Context, apiPath string, v interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, r.BaseURL+apiPath, nil)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	req.Header.Set("Authorization", "Client-ID "+r.ClientID)
+
+	resp, err := r.HTTPClient.Do(req)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return errors.WithStack(&imgurStatusError{APIPath: apiPath, StatusCode: resp.StatusCode, Status: resp.Status})
+	}
+
+	body := struct {
+		Data interface{} `json:"data"`
+	}{Data: v}
+	err = json.NewDecoder(resp.Body).Decode(&body)
+	if err != nil {
+		return errors.Wrapf(err, "could not decode Imgur API response: %#v", apiPath)
+	}
+	return nil
+}
+
+// imgurCandidates keeps the JPEG and PNG images, adding an index to album file names
+func imgurCandidates(images []imgurImage, isAlbum bool) ([]imageCandidate, error) {
+	ret := []imageCandidate{}
+	for i, image := range images {
+		if image.Type != "image/jpeg" && image.Type != "image/png" {
+			continue
+		}
+		urlFileName, err := validateImageURL(image.Link)
+		if err != nil {
+			continue
+		}
+		candidate := newImageCandidate(image.Link, urlFileName)
+		if isAlbum {
+			candidate.Name = indexedName(candidate.Name, i+1)
+		}
+		ret = append(ret, candidate)
+	}
+	if len(ret) == 0 {
+		return nil, errors.New("no downloadable Imgur images")
+	}
+	return ret, nil
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/vartanbeno/go-reddit/v2/reddit"
+)
+
+func Test_parseImgurURL(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		name     string
+		url      string
+		wantID   string
+		wantKind string
+		wantOK   bool
+	}{
+		{name: "page", url: "https://imgur.com/AbC123", wantID: "AbC123", wantKind: imgurKindImage, wantOK: true},
+		{name: "page with extension", url: "https://imgur.com/AbC123.jpg", wantID: "AbC123", wantKind: imgurKindImage, wantOK: true},
+		{name: "album", url: "https://imgur.com/a/AbC123", wantID: "AbC123", wantKind: imgurKindAlbum, wantOK: true},
+		{name: "album with slug", url: "https://imgur.com/a/mountain-lake-AbC123", wantID: "AbC123", wantKind: imgurKindAlbum, wantOK: true},
+		{name: "gallery", url: "https://m.imgur.com/gallery/AbC123", wantID: "AbC123", wantKind: imgurKindGallery, wantOK: true},
+		{name: "direct image", url: "https://i.imgur.com/AbC123.jpg", wantID: "", wantKind: "", wantOK: false},
+		{name: "other host", url: "https://example.com/AbC123", wantID: "", wantKind: "", wantOK: false},
+		{name: "site page", url: "https://imgur.com/upload", wantID: "", wantKind: "", wantOK: false},
+		{name: "short site page", url: "https://imgur.com/about", wantID: "", wantKind: "", wantOK: false},
+		{name: "too long", url: "https://imgur.com/AbC123456", wantID: "", wantKind: "", wantOK: false},
+		{name: "bad characters", url: "https://imgur.com/AbC_12", wantID: "", wantKind: "", wantOK: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			id, kind, ok := parseImgurURL(tt.url)
+			require.Equal(t, tt.wantOK, ok)
+			require.Equal(t, tt.wantID, id)
+			require.Equal(t, tt.wantKind, kind)
+		})
+	}
+}
+
+func TestImgurResolver(t *testing.T) {
+	t.Parallel()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Client-ID myclient" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		switch r.URL.Path {
+		case "/3/image/single":
+			_, _ = w.Write([]byte(`{"data": {"type": "image/png", "link": "https://i.imgur.com/single.png"}, "success": true}`))
+		case "/3/album/album/images":
+			_, _ = w.Write([]byte(`{"data": [
+				{"type": "image/jpeg", "link": "https://i.imgur.com/one.jpg"},
+				{"type": "video/mp4", "link": "https://i.imgur.com/two.mp4"},
+				{"type": "image/png", "link": "https://i.imgur.com/three.png"}
+			], "success": true}`))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	r := newImgurResolver("myclient", server.Client(), newLimiter(1), server.URL)
+
+	images, err := r.Resolve(t.Context(), &reddit.Post{URL: "https://imgur.com/single"})
+	require.NoError(t, err)
+	require.Equal(t, []imageCandidate{{URL: "https://i.imgur.com/single.png", Name: "single", Ext: ".png"}}, images)
+
+	images, err = r.Resolve(t.Context(), &reddit.Post{URL: "https://imgur.com/a/album"})
+	require.NoError(t, err)
+	require.Equal(t, []imageCandidate{
+		{URL: "https://i.imgur.com/one.jpg", Name: "one_01", Ext: ".jpg"},
+		{URL: "https://i.imgur.com/three.png", Name: "three_03", Ext: ".png"},
+	}, images)
+
+	_, err = r.Resolve(t.Context(), &reddit.Post{URL: "https://imgur.com/a/missing"})
+	require.Error(t, err)
+
+	// a gallery post that isn't an album is a single image
+	images, err = r.Resolve(t.Context(), &reddit.Post{URL: "https://imgur.com/gallery/single"})
+	require.NoError(t, err)
+	require.Equal(t, []imageCandidate{{URL: "https://i.imgur.com/single.png", Name: "single", Ext: ".png"}}, images)
+
+	noClientID := newImgurResolver("", server.Client(), newLimiter(1), server.URL)
+
+	images, err = noClientID.Resolve(t.Context(), &reddit.Post{URL: "https://imgur.com/single"})
+	require.NoError(t, err)
+	require.Equal(t, []imageCandidate{{URL: "https://i.imgur.com/single.jpg", Name: "single", Ext: ".jpg"}}, images)
+
+	_, err = noClientID.Resolve(t.Context(), &reddit.Post{URL: "https://imgur.com/a/album"})
+	require.Error(t, err)
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/vartanbeno/go-reddit/v2/reddit"
+)
+
+// Kinds of post sources. A SubredditInfo's name is a subreddit name, "user/<user>/m/<multireddit>", or "user/<user>"
+const (
+	sourceSubreddit   = "subreddit"
+	sourceMultireddit = "multireddit"
+	// sourceUser lists the posts a user submitted
+	sourceUser = "user"
+)
+
+// parseSource returns the kind of source a SubredditInfo's name refers to
+// parseSource("user/bob/m/landscapes") -> "multireddit", nil
+func parseSource(name string) (string, error) {
+	parts := strings.Split(name, "/")
+	for _, part := range parts {
+		if part == "" {
+			return "", errors.Errorf("invalid source: %#v", name)
+		}
+	}
+	switch {
+	case len(parts) == 1:
+		return sourceSubreddit, nil
+	case len(parts) == 2 && parts[0] == "user":
+		return sourceUser, nil
+	case len(parts) == 4 && parts[0] == "user" && parts[2] == "m":
+		return sourceMultireddit, nil
+	default:
+		return "", errors.Errorf("invalid source, expected <subreddit>, user/<user>/m/<multireddit>, or user/<user>: %#v", name)
+	}
+}
+
+// validateSource checks the source's name is well formed, and that the source supports the sort and search
+func validateSource(name string, sort string, search string) error {
+	kind, err := parseSource(name)
+	if err != nil {
+		return err
+	}
+	if kind == sourceUser {
+		if sort == sortRising {
+			return errors.Errorf("sort %s can't be used with user source: %s", sort, name)
+		}
+		if search != "" {
+			return errors.Errorf("search can't be used with user source: %s", name)
+		}
+	}
+	return nil
+}
+
+// listedPost is a post from a listing, with the fields go-reddit doesn't decode
+type listedPost struct {
+	reddit.Post
+	LinkFlairText string `json:"link_flair_text"`
+}
+
+// flairFilter allows posts by their link flair. Matching is case insensitive
+type flairFilter struct {
+	// Allow is the flairs to allow. Empty allows all flairs, including none
+	Allow []string
+	Deny  []string
+}
+
+func (f flairFilter) allows(flair string) bool {
+	for _, deny := range f.Deny {
+		if strings.EqualFold(flair, deny) {
+			return false
+		}
+	}
+	if len(f.Allow) == 0 {
+		return true
+	}
+	for _, allow := range f.Allow {
+		if strings.EqualFold(flair, allow) {
+			return true
+		}
+	}
+	return false
+}
+
+// listingPath returns the API path for a page of the source's posts, after the after cursor
+// listingPath(subreddit{Name: "wallpapers", Sort: "top", Timeframe: "week", ...}, "") -> "r/wallpapers/top?limit=100&t=week"
+func listingPath(sr subreddit, after string) string {
+	// the name was validated by parseSource when the SubredditInfo was parsed
+	kind, _ := parseSource(sr.Name)
+
+	query := url.Values{}
+	query.Set("limit", strconv.Itoa(postsPerPage))
+	if after != "" {
+		query.Set("after", after)
+	}
+	if sr.Timeframe != "" {
+		query.Set("t", sr.Timeframe)
+	}
+	var base string
+	switch kind {
+	case sourceUser:
+		query.Set("sort", sr.Sort)
+		return sr.Name + "/submitted?" + query.Encode()
+	case sourceMultireddit:
+		// multireddit names are already path segments
+		base = sr.Name
+	default:
+		base = "r/" + url.PathEscape(sr.Name)
+	}
+	if sr.Search != "" {
+		query.Set("q", sr.Search)
+		query.Set("restrict_sr", "1")
+		query.Set("sort", sr.Sort)
+		return base + "/search?" + query.Encode()
+	}
+	return base + "/" + sr.Sort + "?" + query.Encode()
+}
+
+// getListing fetches a page of posts and returns them with the cursor for the next page
+func getListing(ctx context.Context, client *reddit.Client, path string) ([]listedPost, string, error) {
+	req, err := client.NewRequest(http.MethodGet, path, nil)
+	if err != nil {
+		return nil, "", errors.WithStack(err)
+	}
+	var listing struct {
+		Data struct {
+			After    string `json:"after"`
+			Children []struct {
+				Data listedPost `json:"data"`
+			} `json:"children"`
+		} `json:"data"`
+	}
+	_, err = client.Do(ctx, req, &listing)
+	if err != nil {
+		return nil, "", errors.WithStack(err)
+	}
+	posts := make([]listedPost, 0, len(listing.Data.Children))
+	for _, child := range listing.Data.Children {
+		posts = append(posts, child.Data)
+	}
+	return posts, listing.Data.After, nil
+}
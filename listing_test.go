@@ -0,0 +1,140 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestFlairFilter_allows(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name   string
+		filter flairFilter
+		flair  string
+		want   bool
+	}{
+		{name: "no lists", filter: flairFilter{Allow: nil, Deny: nil}, flair: "", want: true},
+		{name: "allowed", filter: flairFilter{Allow: []string{"Desktop"}, Deny: nil}, flair: "desktop", want: true},
+		{name: "not allowed", filter: flairFilter{Allow: []string{"Desktop"}, Deny: nil}, flair: "Mobile", want: false},
+		{name: "no flair with allow list", filter: flairFilter{Allow: []string{"Desktop"}, Deny: nil}, flair: "", want: false},
+		{name: "denied", filter: flairFilter{Allow: nil, Deny: []string{"Meta"}}, flair: "Meta", want: false},
+		{name: "deny wins", filter: flairFilter{Allow: []string{"Meta"}, Deny: []string{"Meta"}}, flair: "Meta", want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			require.Equal(t, tt.want, tt.filter.allows(tt.flair))
+		})
+	}
+}
+
+func Test_listingPath(t *testing.T) {
+	t.Parallel()
+
+	sr := subreddit{
+		Name:        "wallpapers",
+		Destination: "",
+		Sort:        sortTop,
+		Timeframe:   "week",
+		Search:      "",
+		Flairs:      flairFilter{Allow: nil, Deny: nil},
+		Count:       5,
+		Resolvers:   nil,
+		Filter:      imageFilter{MinWidth: 0, MinHeight: 0, AspectRatios: nil},
+		TimeBudget:  0,
+		Report:      nil,
+	}
+	require.Equal(t, "r/wallpapers/top?limit=100&t=week", listingPath(sr, ""))
+
+	sr.Sort = sortHot
+	sr.Timeframe = ""
+	require.Equal(t, "r/wallpapers/hot?after=t3_abc&limit=100", listingPath(sr, "t3_abc"))
+
+	sr.Search = "mountain lake"
+	require.Equal(t, "r/wallpapers/search?limit=100&q=mountain+lake&restrict_sr=1&sort=hot", listingPath(sr, ""))
+
+	sr.Name = "user/bob/m/landscapes"
+	require.Equal(t, "user/bob/m/landscapes/search?limit=100&q=mountain+lake&restrict_sr=1&sort=hot", listingPath(sr, ""))
+
+	sr.Search = ""
+	sr.Sort = sortTop
+	sr.Timeframe = "month"
+	require.Equal(t, "user/bob/m/landscapes/top?limit=100&t=month", listingPath(sr, ""))
+
+	sr.Name = "user/bob"
+	require.Equal(t, "user/bob/submitted?limit=100&sort=top&t=month", listingPath(sr, ""))
+}
+
+func Test_validateSource(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name     string
+		source   string
+		sort     string
+		search   string
+		wantKind string
+		wantErr  bool
+	}{
+		{name: "subreddit", source: "wallpapers", sort: sortRising, search: "lake", wantKind: sourceSubreddit, wantErr: false},
+		{name: "multireddit", source: "user/bob/m/landscapes", sort: sortRising, search: "lake", wantKind: sourceMultireddit, wantErr: false},
+		{name: "user", source: "user/bob", sort: sortNew, search: "", wantKind: sourceUser, wantErr: false},
+		{name: "user with rising", source: "user/bob", sort: sortRising, search: "", wantKind: sourceUser, wantErr: true},
+		{name: "user with search", source: "user/bob", sort: sortNew, search: "lake", wantKind: sourceUser, wantErr: true},
+		{name: "empty segment", source: "user//m/landscapes", sort: sortNew, search: "", wantKind: "", wantErr: true},
+		{name: "unknown path", source: "r/wallpapers", sort: sortNew, search: "", wantKind: "", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			err := validateSource(tt.source, tt.sort, tt.search)
+			if tt.wantErr {
+				require.Error(t, err)
+			} else {
+				require.NoError(t, err)
+			}
+			if tt.wantKind != "" {
+				kind, err := parseSource(tt.source)
+				require.NoError(t, err)
+				require.Equal(t, tt.wantKind, kind)
+			}
+		})
+	}
+}
+
+func Test_getListing(t *testing.T) {
+	t.Parallel()
+
+	body := `{"kind": "Listing", "data": {"after": "t3_b", "children": [
+  {"kind": "t3", "data": {"id": "a", "title": "Lake", "url": "https://i.redd.it/a.jpg", "link_flair_text": "Desktop"}},
+  {"kind": "t3", "data": {"id": "b", "title": "Rules", "url": "https://www.reddit.com/r/wallpapers/b", "link_flair_text": null}}
+]}}`
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/r/wallpapers/top" || r.URL.Query().Get("t") != "week" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(body))
+	}))
+	defer server.Close()
+
+	var noSettings httpSettings
+	var noCredentials redditCredentials
+	client, err := newRedditClient(newHTTPTransport(noSettings), noCredentials, server.URL)
+	require.NoError(t, err)
+
+	posts, next, err := getListing(t.Context(), client, "r/wallpapers/top?limit=100&t=week")
+	require.NoError(t, err)
+	require.Equal(t, "t3_b", next)
+	require.Len(t, posts, 2)
+	require.Equal(t, "a", posts[0].ID)
+	require.Equal(t, "https://i.redd.it/a.jpg", posts[0].URL)
+	require.Equal(t, "Desktop", posts[0].LinkFlairText)
+	require.Equal(t, "", posts[1].LinkFlairText)
+}
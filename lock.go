@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// A grab run holds an advisory lock on a file next to its config and in each
+// destination, so scheduled runs can't overlap. The lock files are left in
+// place when released; removing them would race with an instance opening them
+const (
+	lockFileName   = ".grabbit.lock"
+	lockFileSuffix = ".lock"
+	// lockPollInterval is how often a waiting run checks if the lock was released
+	lockPollInterval = 250 * time.Millisecond
+)
+
+// lockHeldError means another grabbit holds a lock
+type lockHeldError struct {
+	Path string
+	// Holder describes the process holding the lock, if known. Ex: "pid 1234"
+	Holder string
+}
+
+func (e *lockHeldError) Error() string {
+	holder := "another grabbit"
+	if e.Holder != "" {
+		holder += " (" + e.Holder + ")"
+	}
+	return fmt.Sprintf("%s is already running with %s. Wait for it to finish or pass --lock-wait", holder, e.Path)
+}
+
+func (e *lockHeldError) ExitCode() int {
+	return exitCodeLocked
+}
+
+// lockCancelledError means the run was cancelled while waiting for a lock
+type lockCancelledError struct {
+	Path string
+	Err  error
+}
+
+func (e *lockCancelledError) Error() string {
+	return fmt.Sprintf("cancelled while waiting for %s: %s", e.Path, e.Err)
+}
+
+func (e *lockCancelledError) Unwrap() error {
+	return e.Err
+}
+
+func (e *lockCancelledError) ExitCode() int {
+	return exitCodeCancelled
+}
+
+// runLockPaths returns the lock files for a run: one next to the config if it
+// exists, and one in each destination that exists. They're sorted so every
+// instance locks them in the same order, so waiting instances can't deadlock
+func runLockPaths(configPath string, destinations []string) []string {
+	var paths []string
+	if info, err := os.Stat(configPath); err == nil && info.Mode().IsRegular() {
+		paths = append(paths, configPath+lockFileSuffix)
+	}
+	for _, d := range destinations {
+		info, err := os.Stat(d)
+		if err != nil || !info.IsDir() {
+			// the subreddit fails with a better error later
+			continue
+		}
+		paths = append(paths, filepath.Join(filepath.Clean(d), lockFileName))
+	}
+	slices.Sort(paths)
+	return slices.Compact(paths)
+}
+
+// runLock is the set of locks held by a run
+type runLock struct {
+	files []*os.File
+}
+
+// acquireRunLock locks every path. If another grabbit holds one, it retries
+// until wait runs out and then returns a *lockHeldError, or until ctx is done
+// and then returns a *lockCancelledError
+func acquireRunLock(ctx context.Context, paths []string, wait time.Duration) (*runLock, error) {
+	lock := &runLock{files: nil}
+	deadline := time.Now().Add(wait)
+	for _, p := range paths {
+		file, err := acquireLockFile(ctx, p, deadline)
+		if err != nil {
+			_ = lock.release()
+			return nil, err
+		}
+		lock.files = append(lock.files, file)
+	}
+	return lock, nil
+}
+
+// acquireLockFile locks lockPath, polling until deadline if another process holds it
+func acquireLockFile(ctx context.Context, lockPath string, deadline time.Time) (*os.File, error) {
+	file, err := os.OpenFile(lockPath, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, errors.Wrapf(err, "could not open lock file: %#v", lockPath)
+	}
+	for {
+		locked, err := tryLockFile(file)
+		if err != nil {
+			file.Close()
+			return nil, errors.Wrapf(err, "could not lock: %#v", lockPath)
+		}
+		if locked {
+			break
+		}
+		if time.Now().Add(lockPollInterval).After(deadline) {
+			file.Close()
+			return nil, errors.WithStack(&lockHeldError{Path: lockPath, Holder: readLockHolder(lockPath)})
+		}
+		err = sleepContext(ctx, lockPollInterval)
+		if err != nil {
+			file.Close()
+			return nil, errors.WithStack(&lockCancelledError{Path: lockPath, Err: err})
+		}
+	}
+
+	// record who holds the lock for the error message of other instances
+	err = file.Truncate(0)
+	if err == nil {
+		_, err = file.WriteAt([]byte("pid "+strconv.Itoa(os.Getpid())+"\n"), 0)
+	}
+	if err != nil {
+		_ = unlockFile(file)
+		file.Close()
+		return nil, errors.Wrapf(err, "could not write lock file: %#v", lockPath)
+	}
+	return file, nil
+}
+
+// readLockHolder returns the holder recorded in a lock file, or "" if it can't be read
+func readLockHolder(lockPath string) string {
+	content, err := os.ReadFile(lockPath)
+	if err != nil {
+		// Windows doesn't allow reading a locked file
+		return ""
+	}
+	return strings.TrimSpace(string(content))
+}
+
+// release unlocks and closes every lock file. Closing a file also releases its lock
+func (l *runLock) release() error {
+	var firstErr error
+	for _, file := range l.files {
+		err := unlockFile(file)
+		if err == nil {
+			err = errors.WithStack(file.Close())
+		} else {
+			file.Close()
+		}
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	l.files = nil
+	return firstErr
+}
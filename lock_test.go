@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func Test_runLockPaths(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	a := filepath.Join(dir, "a")
+	b := filepath.Join(dir, "b")
+	require.NoError(t, os.Mkdir(a, 0755))
+	require.NoError(t, os.Mkdir(b, 0755))
+	configPath := filepath.Join(dir, "grabbit.yaml")
+	require.NoError(t, os.WriteFile(configPath, []byte("version: v5\n"), 0600))
+
+	paths := runLockPaths(configPath, []string{b, a, a + "/", filepath.Join(dir, "missing")})
+	require.Equal(t, []string{
+		filepath.Join(a, lockFileName),
+		filepath.Join(b, lockFileName),
+		filepath.Join(dir, "grabbit.yaml"+lockFileSuffix),
+	}, paths)
+
+	// a missing config isn't locked, so its directory isn't created or written to
+	paths = runLockPaths(filepath.Join(dir, "missing", "grabbit.yaml"), []string{a})
+	require.Equal(t, []string{filepath.Join(a, lockFileName)}, paths)
+}
+
+func Test_acquireRunLock(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	configPath := filepath.Join(dir, "grabbit.yaml")
+	require.NoError(t, os.WriteFile(configPath, []byte("version: v5\n"), 0600))
+	paths := runLockPaths(configPath, []string{dir})
+	require.Len(t, paths, 2)
+
+	first, err := acquireRunLock(t.Context(), paths, 0)
+	require.NoError(t, err)
+
+	// a second instance exits at once
+	_, err = acquireRunLock(t.Context(), paths, 0)
+	var held *lockHeldError
+	require.ErrorAs(t, err, &held)
+	require.Equal(t, "pid "+strconv.Itoa(os.Getpid()), held.Holder)
+	require.Equal(t, exitCodeLocked, exitCode(err))
+
+	// or stops waiting when cancelled
+	ctx, cancel := context.WithCancel(t.Context())
+	cancel()
+	_, err = acquireRunLock(ctx, paths, time.Minute)
+	require.ErrorIs(t, err, context.Canceled)
+	require.Equal(t, exitCodeCancelled, exitCode(err))
+
+	// or gets the lock when the first instance finishes
+	go func() {
+		time.Sleep(2 * lockPollInterval)
+		_ = first.release()
+	}()
+	second, err := acquireRunLock(t.Context(), paths, time.Minute)
+	require.NoError(t, err)
+	require.NoError(t, second.release())
+
+	// lock files are left in place
+	for _, p := range paths {
+		require.FileExists(t, p)
+	}
+}
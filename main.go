@@ -1,6 +1,8 @@
 package main
 
 import (
+	"fmt"
+	"os"
 	"time"
 
 	"go.bbkane.com/warg"
@@ -24,6 +26,12 @@ func app() *warg.App {
   # Grab from config file
   grabbit grab
 
+  # Report near-duplicate images in a directory
+  grabbit dedupe --destination ./images
+
+  # Allow a previously grabbed image to be grabbed again
+  grabbit history forget --post-id abc123
+
 Homepage: https://github.com/bbkane/grabbit
 `
 
@@ -62,6 +70,17 @@ Homepage: https://github.com/bbkane/grabbit
 		),
 	}
 
+	historyFlags := warg.FlagMap{
+		"--history-filename": warg.NewFlag(
+			"History of grabbed images. Images in it aren't downloaded again, even if their file was moved or deleted",
+			scalar.Path(
+				scalar.Default(path.New("~/.config/grabbit-history.jsonl")),
+			),
+			warg.ConfigPath("history.filename"),
+			warg.Required(),
+		),
+	}
+
 	app := warg.New(
 		"grabbit",
 		version,
@@ -72,25 +91,271 @@ Homepage: https://github.com/bbkane/grabbit
 				"Grab images. Optionally use `config edit` first to create a config",
 				grab,
 				warg.CmdFlagMap(logFlags),
+				warg.CmdFlagMap(historyFlags),
+				warg.NewCmdFlag(
+					"--concurrency",
+					"Max number of Reddit requests and image downloads in flight at once",
+					scalar.Int(
+						scalar.Default(4),
+					),
+					warg.ConfigPath("concurrency"),
+					warg.Required(),
+				),
+				warg.NewCmdFlag(
+					"--aspect-ratio",
+					"Allowed aspect ratio as <width>:<height>[~<tolerance>%]. Without a tolerance the ratio must match exactly, so use 16:9~1% to also allow sizes like 1366x768. Pass multiple times to allow several. Overridden by a subreddit's aspectratios",
+					slice.String(),
+					warg.ConfigPath("filters.aspectratios"),
+				),
 				warg.NewCmdFlag(
 					"--destination",
-					"Destination directory for downloads",
+					"Destination directory for downloads. Overridden by a subreddit's destination",
 					scalar.Path(scalar.Default(path.New("."))),
 					warg.Alias("-d"),
 					warg.ConfigPath("destination"),
 					warg.FlagCompletions(warg.CompletionsDirectoriesFiles()),
 					warg.Required(),
 				),
+				warg.NewCmdFlag(
+					"--dry-run",
+					"Print what would be downloaded instead of downloading. Printed to stderr if the --report is written to stdout",
+					scalar.Bool(
+						scalar.Default(false),
+					),
+					warg.Required(),
+				),
+				warg.NewCmdFlag(
+					"--duplicates",
+					"What to do with a downloaded image whose content matches a file already in the destination",
+					scalar.String(
+						scalar.Choices(duplicatesKeep, duplicatesDiscard, duplicatesHardlink),
+						scalar.Default(duplicatesKeep),
+					),
+					warg.ConfigPath("duplicates"),
+					warg.Required(),
+				),
+				warg.NewCmdFlag(
+					"--fail-on",
+					"Run outcomes that exit with an error: total (nothing downloaded and something failed or ran out of time), partial (something failed or ran out of time), nothing-new (nothing failed or downloaded)",
+					slice.String(
+						slice.Choices(outcomeTotalFailure, outcomePartialFailure, outcomeNothingNew),
+						slice.Default([]string{outcomeTotalFailure, outcomePartialFailure}),
+					),
+					warg.ConfigPath("failon"),
+				),
+				warg.NewCmdFlag(
+					"--imgur-client-id",
+					"Imgur API client ID. Required to download Imgur albums",
+					scalar.String(),
+					warg.ConfigPath("imgur.clientid"),
+					warg.EnvVars("GRABBIT_IMGUR_CLIENT_ID"),
+				),
+				warg.NewCmdFlag(
+					"--lock-wait",
+					"How long to wait for another grabbit running with the same config or destination to finish, like 10m. Unset means exit at once",
+					scalar.Duration(),
+					warg.ConfigPath("lockwait"),
+				),
+				warg.NewCmdFlag(
+					"--max-download-size",
+					"Max size of a downloaded image in megabytes. Larger images are skipped. 0 means no limit",
+					scalar.Int(
+						scalar.Default(100),
+					),
+					warg.ConfigPath("download.maxsize"),
+					warg.Required(),
+				),
+				warg.NewCmdFlag(
+					"--max-pages",
+					"Max pages of 100 posts to fetch per subreddit while looking for <count> images. Images already downloaded count, NSFW posts, failed downloads, and images rejected by filters don't",
+					scalar.Int(
+						scalar.Default(5),
+					),
+					warg.ConfigPath("maxpages"),
+					warg.Required(),
+				),
+				warg.NewCmdFlag(
+					"--max-retries",
+					"Max retries of a Reddit request or image download that failed with a network error, 429, or 5xx status",
+					scalar.Int(
+						scalar.Default(3),
+					),
+					warg.ConfigPath("retry.maxretries"),
+					warg.Required(),
+				),
+				warg.NewCmdFlag(
+					"--max-run-time",
+					"Max time for the whole run, like 30m. Remaining subreddits and posts are skipped and reported when it runs out. Subreddits can also have a timebudget. Unset means no limit",
+					scalar.Duration(),
+					warg.ConfigPath("maxruntime"),
+				),
+				warg.NewCmdFlag(
+					"--min-height",
+					"Minimum image height in pixels. Overridden by a subreddit's minheight",
+					scalar.Int(
+						scalar.Default(0),
+					),
+					warg.ConfigPath("filters.minheight"),
+					warg.Required(),
+				),
+				warg.NewCmdFlag(
+					"--min-width",
+					"Minimum image width in pixels. Overridden by a subreddit's minwidth",
+					scalar.Int(
+						scalar.Default(0),
+					),
+					warg.ConfigPath("filters.minwidth"),
+					warg.Required(),
+				),
+				warg.NewCmdFlag(
+					"--near-duplicates",
+					"What to do with a downloaded image that looks like one in the destination or history. Needs --perceptual-hash",
+					scalar.String(
+						scalar.Choices(nearDuplicatesReject, nearDuplicatesKeepLarger),
+						scalar.Default(nearDuplicatesReject),
+					),
+					warg.ConfigPath("nearduplicates.action"),
+					warg.Required(),
+				),
+				warg.NewCmdFlag(
+					"--path-template",
+					"Where to save images in the destination. Placeholders: {subreddit}, {title}, {id}, {author}, {name} (the image's file name), {ext}, and the post's {yyyy}, {mm}, and {dd}. Use / for subdirectories. Keep {name} so gallery images get different files. Ex: {subreddit}/{yyyy}/{mm}/{title}_{name}.{ext}",
+					scalar.String(
+						scalar.Default(defaultPathTemplate),
+					),
+					warg.ConfigPath("pathtemplate"),
+					warg.Required(),
+				),
+				warg.NewCmdFlag(
+					"--perceptual-hash",
+					"Perceptual hash algorithm used to find near-duplicate images",
+					scalar.String(
+						scalar.Choices(perceptualNone, perceptualAHash, perceptualDHash, perceptualPHash),
+						scalar.Default(perceptualNone),
+					),
+					warg.ConfigPath("nearduplicates.hash"),
+					warg.Required(),
+				),
+				warg.NewCmdFlag(
+					"--perceptual-threshold",
+					"Max Hamming distance between the perceptual hashes of near-duplicate images",
+					scalar.Int(
+						scalar.Default(5),
+					),
+					warg.ConfigPath("nearduplicates.threshold"),
+					warg.Required(),
+				),
+				warg.NewCmdFlag(
+					"--proxy",
+					"Proxy URL for Reddit requests and image downloads, like http://localhost:8080. Defaults to the HTTP_PROXY, HTTPS_PROXY, and NO_PROXY env vars",
+					scalar.String(),
+					warg.ConfigPath("proxy"),
+				),
+				warg.NewCmdFlag(
+					"--reddit-client-id",
+					"Reddit script app client ID. Without it, grabbit uses Reddit's read-only API",
+					scalar.String(),
+					warg.ConfigPath("reddit.clientid"),
+					warg.EnvVars("GRABBIT_REDDIT_CLIENT_ID"),
+				),
+				warg.NewCmdFlag(
+					"--reddit-client-secret",
+					"Reddit script app client secret",
+					scalar.String(),
+					warg.ConfigPath("reddit.clientsecret"),
+					warg.EnvVars("GRABBIT_REDDIT_CLIENT_SECRET"),
+				),
+				warg.NewCmdFlag(
+					"--reddit-password",
+					"Reddit account password. Used with --reddit-username when there's no refresh token",
+					scalar.String(),
+					warg.ConfigPath("reddit.password"),
+					warg.EnvVars("GRABBIT_REDDIT_PASSWORD"),
+				),
+				warg.NewCmdFlag(
+					"--reddit-refresh-token",
+					"Reddit OAuth refresh token",
+					scalar.String(),
+					warg.ConfigPath("reddit.refreshtoken"),
+					warg.EnvVars("GRABBIT_REDDIT_REFRESH_TOKEN"),
+				),
+				warg.NewCmdFlag(
+					"--reddit-username",
+					"Reddit account username. Used with --reddit-password when there's no refresh token",
+					scalar.String(),
+					warg.ConfigPath("reddit.username"),
+					warg.EnvVars("GRABBIT_REDDIT_USERNAME"),
+				),
+				warg.NewCmdFlag(
+					"--report",
+					"Write a summary of the run when it finishes",
+					scalar.String(
+						scalar.Choices(reportNone, reportJSON),
+						scalar.Default(reportNone),
+					),
+					warg.ConfigPath("report.format"),
+					warg.Required(),
+				),
+				warg.NewCmdFlag(
+					"--report-filename",
+					"File to write the --report to. Defaults to stdout",
+					scalar.Path(),
+					warg.ConfigPath("report.filename"),
+					warg.FlagCompletions(warg.CompletionsDirectoriesFiles()),
+				),
+				warg.NewCmdFlag(
+					"--retry-base-delay",
+					"Delay before the first retry. It doubles for each retry after, with jitter. Retry-After and X-Ratelimit-Reset headers take precedence",
+					scalar.Duration(
+						scalar.Default(time.Second),
+					),
+					warg.ConfigPath("retry.basedelay"),
+					warg.Required(),
+				),
+				warg.NewCmdFlag(
+					"--retry-max-delay",
+					"Max delay between retries, including delays asked for by Retry-After and X-Ratelimit-Reset headers",
+					scalar.Duration(
+						scalar.Default(time.Second*30),
+					),
+					warg.ConfigPath("retry.maxdelay"),
+					warg.Required(),
+				),
+				warg.NewCmdFlag(
+					"--sanitize",
+					"Characters allowed in file names: posix replaces separators, spaces, and control characters. windows-safe also replaces characters Windows rejects, trims trailing dots, and avoids reserved names like CON. ascii-only also replaces non-ASCII characters like emoji",
+					scalar.String(
+						scalar.Choices(sanitizePosix, sanitizeWindowsSafe, sanitizeASCIIOnly),
+						scalar.Default(defaultSanitizeProfile()),
+					),
+					warg.ConfigPath("sanitize"),
+					warg.Required(),
+				),
 				warg.NewCmdFlag(
 					"--subreddit-info",
-					"<subreddit>,<day|week|month|year|all>,<count>",
+					"<source>,<listing>,<count>[,<key>=<value>...]. <source> is <subreddit>, user/<user>/m/<multireddit>, or user/<user> (posts the user submitted). <listing> is <day|week|month|year|all> (top posts), <hot|new|rising>, or <top|controversial>:<day|week|month|year|all>. Keys: destination, enableresolvers, disableresolvers, minwidth, minheight, aspectratios, search, allowflairs, denyflairs (lists separated by +), timebudget (max time to grab the subreddit, like 5m)",
 					slice.New(
 						SubredditInfoTypeInfo(),
 						slice.Default([]SubredditInfo{
 							{
-								Subreddit: "earthporn",
-								Timeframe: "week",
-								Count:     2,
+								Subreddit:        "earthporn",
+								Sort:             sortTop,
+								Timeframe:        "week",
+								Count:            2,
+								EnableResolvers:  nil,
+								DisableResolvers: nil,
+								Filter: imageFilter{
+									MinWidth:     0,
+									MinHeight:    0,
+									AspectRatios: nil,
+								},
+								Search: "",
+								Flairs: flairFilter{
+									Allow: nil,
+									Deny:  nil,
+								},
+								Destination: "",
+								TimeBudget:  0,
 							},
 						}),
 					),
@@ -99,7 +364,7 @@ Homepage: https://github.com/bbkane/grabbit
 				),
 				warg.NewCmdFlag(
 					"--timeout",
-					"Timeout for a single download",
+					"Timeout for a single Reddit request or image download attempt. Interrupted downloads are resumed with a new timeout",
 					scalar.Duration(
 						scalar.Default(time.Second*30),
 					),
@@ -107,7 +372,87 @@ Homepage: https://github.com/bbkane/grabbit
 					warg.Required(),
 				),
 			),
+			warg.NewSubCmd(
+				"dedupe",
+				"Find near-duplicate images in a directory",
+				dedupe,
+				warg.CmdFlagMap(logFlags),
+				warg.NewCmdFlag(
+					"--destination",
+					"Directory to search",
+					scalar.Path(scalar.Default(path.New("."))),
+					warg.Alias("-d"),
+					warg.ConfigPath("destination"),
+					warg.FlagCompletions(warg.CompletionsDirectoriesFiles()),
+					warg.Required(),
+				),
+				warg.NewCmdFlag(
+					"--perceptual-hash",
+					"Perceptual hash algorithm",
+					scalar.String(
+						scalar.Choices(perceptualAHash, perceptualDHash, perceptualPHash),
+						scalar.Default(perceptualDHash),
+					),
+					warg.Required(),
+				),
+				warg.NewCmdFlag(
+					"--perceptual-threshold",
+					"Max Hamming distance between the perceptual hashes of near-duplicate images",
+					scalar.Int(
+						scalar.Default(5),
+					),
+					warg.ConfigPath("nearduplicates.threshold"),
+					warg.Required(),
+				),
+				warg.NewCmdFlag(
+					"--remove",
+					"Remove near-duplicates, keeping the highest resolution image of each group",
+					scalar.Bool(
+						scalar.Default(false),
+					),
+					warg.Required(),
+				),
+			),
 			warg.SectionFooter(appFooter),
+			warg.NewSubSection(
+				"history",
+				"Download history commands",
+				warg.NewSubCmd(
+					"list",
+					"List grabbed images",
+					historyList,
+					warg.CmdFlagMap(historyFlags),
+				),
+				warg.NewSubCmd(
+					"search",
+					"Search grabbed images by subreddit, title, post ID, URL, or file path",
+					historySearch,
+					warg.CmdFlagMap(historyFlags),
+					warg.NewCmdFlag(
+						"--query",
+						"Case insensitive text to search for",
+						scalar.String(),
+						warg.Alias("-q"),
+						warg.Required(),
+					),
+				),
+				warg.NewSubCmd(
+					"forget",
+					"Remove images from history so they can be grabbed again",
+					historyForget,
+					warg.CmdFlagMap(historyFlags),
+					warg.NewCmdFlag(
+						"--post-id",
+						"Post ID to forget",
+						slice.String(),
+					),
+					warg.NewCmdFlag(
+						"--url",
+						"Image URL to forget",
+						slice.String(),
+					),
+				),
+			),
 			warg.NewSubSection(
 				"config",
 				"Config commands",
@@ -150,5 +495,14 @@ Homepage: https://github.com/bbkane/grabbit
 
 func main() {
 	app := app()
-	app.MustRun()
+	parsed, err := app.Parse()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Parse error:", err)
+		os.Exit(exitCodeParseError)
+	}
+	err = parsed.Action(parsed.Context)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error:", err)
+		os.Exit(exitCode(err))
+	}
 }
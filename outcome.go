@@ -0,0 +1,115 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+
+	"github.com/pkg/errors"
+)
+
+// Outcomes of a grab run. All but outcomeSuccess and outcomeCancelled can be
+// passed to --fail-on
+const (
+	outcomeSuccess = "success"
+	// outcomeTotalFailure means nothing was downloaded and something failed or ran out of time
+	outcomeTotalFailure = "total"
+	// outcomePartialFailure means some images were downloaded and something failed or ran out of time
+	outcomePartialFailure = "partial"
+	// outcomeNothingNew means nothing failed, but nothing was downloaded either
+	outcomeNothingNew = "nothing-new"
+	// outcomeCancelled means the run was stopped by SIGINT or SIGTERM. It's always an error
+	outcomeCancelled = "cancelled"
+)
+
+// Exit codes returned by main. Parse errors use warg's 64
+const (
+	exitCodeError          = 1
+	exitCodeTotalFailure   = 2
+	exitCodePartialFailure = 3
+	exitCodeNothingNew     = 4
+	// exitCodeLocked means another grabbit was running with the same config or destination
+	exitCodeLocked     = 5
+	exitCodeParseError = 64
+	// exitCodeCancelled is what shells return for a process killed by SIGINT
+	exitCodeCancelled = 130
+)
+
+// outcome classifies a finished run. Running out of time, overall or for a
+// subreddit, is a failure because images were left behind. A dry run
+// downloads nothing, so it's never outcomeNothingNew
+func (r *runReport) outcome() string {
+	failed := r.Failed > 0 || r.stoppedEarly()
+	switch {
+	case r.Cancelled:
+		return outcomeCancelled
+	case failed && r.Downloaded == 0:
+		return outcomeTotalFailure
+	case failed:
+		return outcomePartialFailure
+	case r.Downloaded == 0 && !r.DryRun:
+		return outcomeNothingNew
+	default:
+		return outcomeSuccess
+	}
+}
+
+// runFailedError is returned by grab when the run's outcome is in --fail-on
+type runFailedError struct {
+	Outcome    string
+	Downloaded int
+	Failed     int
+}
+
+func (e *runFailedError) Error() string {
+	switch e.Outcome {
+	case outcomeTotalFailure:
+		return fmt.Sprintf("run failed: %d failures and no images downloaded", e.Failed)
+	case outcomePartialFailure:
+		return fmt.Sprintf("run partially failed: %d failures and %d images downloaded", e.Failed, e.Downloaded)
+	case outcomeCancelled:
+		return fmt.Sprintf("run cancelled: %d failures and %d images downloaded", e.Failed, e.Downloaded)
+	default:
+		return "run downloaded no new images"
+	}
+}
+
+func (e *runFailedError) ExitCode() int {
+	switch e.Outcome {
+	case outcomeTotalFailure:
+		return exitCodeTotalFailure
+	case outcomePartialFailure:
+		return exitCodePartialFailure
+	case outcomeNothingNew:
+		return exitCodeNothingNew
+	case outcomeCancelled:
+		return exitCodeCancelled
+	default:
+		return exitCodeError
+	}
+}
+
+// checkFailOn returns a *runFailedError if the report's outcome is one of
+// failOn, or the run was cancelled
+func checkFailOn(r *runReport, failOn []string) error {
+	if r.Outcome != outcomeCancelled && (r.Outcome == outcomeSuccess || !slices.Contains(failOn, r.Outcome)) {
+		return nil
+	}
+	return &runFailedError{
+		Outcome:    r.Outcome,
+		Downloaded: r.Downloaded,
+		Failed:     r.Failed,
+	}
+}
+
+// exitCode returns the process exit code for an error returned by a command
+func exitCode(err error) int {
+	if err == nil {
+		return 0
+	}
+	// *runFailedError, *lockHeldError, and *lockCancelledError choose their exit codes
+	var coded interface{ ExitCode() int }
+	if errors.As(err, &coded) {
+		return coded.ExitCode()
+	}
+	return exitCodeError
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCheckFailOn(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name         string
+		downloaded   int
+		failed       int
+		dryRun       bool
+		cancelled    bool
+		outOfTime    bool
+		failOn       []string
+		wantOutcome  string
+		wantExitCode int
+	}{
+		{
+			name:         "success",
+			downloaded:   2,
+			failed:       0,
+			dryRun:       false,
+			cancelled:    false,
+			outOfTime:    false,
+			failOn:       []string{outcomeTotalFailure, outcomePartialFailure, outcomeNothingNew},
+			wantOutcome:  outcomeSuccess,
+			wantExitCode: 0,
+		},
+		{
+			name:         "total failure",
+			downloaded:   0,
+			failed:       2,
+			dryRun:       false,
+			cancelled:    false,
+			outOfTime:    false,
+			failOn:       []string{outcomeTotalFailure},
+			wantOutcome:  outcomeTotalFailure,
+			wantExitCode: exitCodeTotalFailure,
+		},
+		{
+			name:         "partial failure",
+			downloaded:   1,
+			failed:       1,
+			dryRun:       false,
+			cancelled:    false,
+			outOfTime:    false,
+			failOn:       []string{outcomeTotalFailure, outcomePartialFailure},
+			wantOutcome:  outcomePartialFailure,
+			wantExitCode: exitCodePartialFailure,
+		},
+		{
+			name:         "partial failure not in fail-on",
+			downloaded:   1,
+			failed:       1,
+			dryRun:       false,
+			cancelled:    false,
+			outOfTime:    false,
+			failOn:       []string{outcomeTotalFailure},
+			wantOutcome:  outcomePartialFailure,
+			wantExitCode: 0,
+		},
+		{
+			name:         "nothing new",
+			downloaded:   0,
+			failed:       0,
+			dryRun:       false,
+			cancelled:    false,
+			outOfTime:    false,
+			failOn:       []string{outcomeNothingNew},
+			wantOutcome:  outcomeNothingNew,
+			wantExitCode: exitCodeNothingNew,
+		},
+		{
+			name:         "dry run is never nothing new",
+			downloaded:   0,
+			failed:       0,
+			dryRun:       true,
+			cancelled:    false,
+			outOfTime:    false,
+			failOn:       []string{outcomeNothingNew},
+			wantOutcome:  outcomeSuccess,
+			wantExitCode: 0,
+		},
+		{
+			name:         "cancelled is always an error",
+			downloaded:   1,
+			failed:       0,
+			dryRun:       false,
+			cancelled:    true,
+			outOfTime:    false,
+			failOn:       nil,
+			wantOutcome:  outcomeCancelled,
+			wantExitCode: exitCodeCancelled,
+		},
+		{
+			name:         "out of time with nothing downloaded",
+			downloaded:   0,
+			failed:       0,
+			dryRun:       false,
+			cancelled:    false,
+			outOfTime:    true,
+			failOn:       []string{outcomeTotalFailure, outcomePartialFailure},
+			wantOutcome:  outcomeTotalFailure,
+			wantExitCode: exitCodeTotalFailure,
+		},
+		{
+			name:         "out of time after some downloads",
+			downloaded:   1,
+			failed:       0,
+			dryRun:       false,
+			cancelled:    false,
+			outOfTime:    true,
+			failOn:       []string{outcomeTotalFailure, outcomePartialFailure},
+			wantOutcome:  outcomePartialFailure,
+			wantExitCode: exitCodePartialFailure,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			report := newRunReport(tt.dryRun)
+			sr := report.addSubreddit("wallpapers", sortTop, "week")
+			for i := 0; i < tt.downloaded; i++ {
+				sr.downloaded(reportFile{Path: fmt.Sprintf("/tmp/%d.jpg", i), URL: "", PostID: "", Bytes: 1, SHA256: ""})
+			}
+			for i := 0; i < tt.failed; i++ {
+				sr.fail()
+			}
+			if tt.outOfTime {
+				sr.outOfTime(2)
+			}
+			report.Cancelled = tt.cancelled
+			report.finish()
+			require.Equal(t, tt.wantOutcome, report.Outcome)
+
+			err := checkFailOn(report, tt.failOn)
+			require.Equal(t, tt.wantExitCode, exitCode(err))
+			if err != nil {
+				// wrapping keeps the exit code
+				require.Equal(t, tt.wantExitCode, exitCode(fmt.Errorf("grab: %w", err)))
+			}
+		})
+	}
+}
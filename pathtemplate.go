@@ -0,0 +1,129 @@
+package main
+
+import (
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/vartanbeno/go-reddit/v2/reddit"
+)
+
+// defaultPathTemplate names files like grabbit always has: <subreddit>_<title>_<url file name>
+const defaultPathTemplate = "{subreddit}_{title}_{name}.{ext}"
+
+// maxPathLength is the longest file path genFilePath returns. Titles are trimmed to fit
+const maxPathLength = 250
+
+// pathFields are the values of a path template's placeholders
+type pathFields struct {
+	Subreddit string
+	Title     string
+	PostID    string
+	Author    string
+	// Name is the image's file name without extension, usually from its URL
+	Name string
+	// Ext is the image's file extension, without the leading dot
+	Ext string
+	// Created is when the post was created, in UTC
+	Created time.Time
+}
+
+// newPathFields returns the fields for an image from a post
+func newPathFields(subredditName string, post *reddit.Post, candidate imageCandidate) pathFields {
+	var created time.Time
+	if post.Created != nil {
+		created = post.Created.UTC()
+	}
+	return pathFields{
+		Subreddit: subredditName,
+		Title:     post.Title,
+		PostID:    post.ID,
+		Author:    post.Author,
+		Name:      candidate.Name,
+		Ext:       strings.TrimPrefix(candidate.Ext, "."),
+		Created:   created,
+	}
+}
+
+// nolint: gochecknoglobals // readonly map used for validation
+var pathTemplatePlaceholders = map[string]bool{
+	"subreddit": true,
+	"title":     true,
+	"id":        true,
+	"author":    true,
+	"name":      true,
+	"ext":       true,
+	"yyyy":      true,
+	"mm":        true,
+	"dd":        true,
+}
+
+// nolint: gochecknoglobals // readonly regexp
+var placeholderRegexp = regexp.MustCompile(`\{([^{}]*)\}`)
+
+// validatePathTemplate checks a template only uses known placeholders, stays
+// within the destination directory, and ends with the image's extension
+func validatePathTemplate(template string) error {
+	for _, match := range placeholderRegexp.FindAllStringSubmatch(template, -1) {
+		if !pathTemplatePlaceholders[match[1]] {
+			return errors.Errorf("unknown placeholder in path template: {%s}", match[1])
+		}
+	}
+	if filepath.IsAbs(template) || strings.HasPrefix(template, "/") {
+		return errors.Errorf("path template must be relative to the destination: %#v", template)
+	}
+	for _, segment := range strings.Split(template, "/") {
+		if segment == "" || segment == "." || segment == ".." {
+			return errors.Errorf("path template can't have empty, . or .. directories: %#v", template)
+		}
+	}
+	if !strings.HasSuffix(template, ".{ext}") {
+		return errors.Errorf("path template must end with .{ext}: %#v", template)
+	}
+	return nil
+}
+
+// expandPathTemplate replaces the template's placeholders with fields
+// sanitized for profile. Slashes in the template separate directories, but
+// slashes in fields don't
+func expandPathTemplate(template string, profile string, fields pathFields) string {
+	expanded := strings.NewReplacer(
+		"{subreddit}", sanitizeField(profile, fields.Subreddit),
+		"{title}", sanitizeField(profile, fields.Title),
+		"{id}", sanitizeField(profile, fields.PostID),
+		"{author}", sanitizeField(profile, fields.Author),
+		"{name}", sanitizeField(profile, fields.Name),
+		"{ext}", sanitizeField(profile, fields.Ext),
+		"{yyyy}", fields.Created.Format("2006"),
+		"{mm}", fields.Created.Format("01"),
+		"{dd}", fields.Created.Format("02"),
+	).Replace(template)
+	components := strings.Split(expanded, "/")
+	for i, c := range components {
+		components[i] = sanitizeComponent(profile, c)
+	}
+	return filepath.Join(components...)
+}
+
+// genFilePath returns where to save an image: the expanded template inside
+// destinationDir. If the path is too long for the OS to handle, the title is
+// trimmed to fit, without splitting runes
+// genFilePath("/pics", "{subreddit}/{title}.{ext}", sanitizePosix, pathFields{Subreddit: "wallpapers", Title: "a lake", Ext: "jpg", ...}) -> "/pics/wallpapers/a_lake.jpg", nil
+func genFilePath(destinationDir string, template string, profile string, fields pathFields) (string, error) {
+	fields.Title = sanitizeField(profile, fields.Title)
+	filePath := filepath.Join(destinationDir, expandPathTemplate(template, profile, fields))
+
+	titleCount := strings.Count(template, "{title}")
+	if len(filePath) > maxPathLength && titleCount > 0 {
+		// round up so every {title} is trimmed enough
+		toChop := (len(filePath) - maxPathLength + titleCount - 1) / titleCount
+		fields.Title = truncateRunes(fields.Title, len(fields.Title)-toChop)
+		filePath = filepath.Join(destinationDir, expandPathTemplate(template, profile, fields))
+	}
+	if len(filePath) > maxPathLength {
+		return "", errors.Errorf("filePath to long and title too short: %#v\n", filePath)
+	}
+	return filePath, nil
+}
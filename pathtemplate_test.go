@@ -0,0 +1,105 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func Test_validatePathTemplate(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name     string
+		template string
+		wantErr  bool
+	}{
+		{name: "default", template: defaultPathTemplate, wantErr: false},
+		{name: "subdirectories", template: "{subreddit}/{yyyy}/{mm}/{title}_{id}.{ext}", wantErr: false},
+		{name: "unknown placeholder", template: "{subreddit}/{score}.{ext}", wantErr: true},
+		{name: "absolute", template: "/{subreddit}/{name}.{ext}", wantErr: true},
+		{name: "parent directory", template: "../{subreddit}/{name}.{ext}", wantErr: true},
+		{name: "empty directory", template: "{subreddit}//{name}.{ext}", wantErr: true},
+		{name: "no extension", template: "{subreddit}/{name}", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			err := validatePathTemplate(tt.template)
+			if tt.wantErr {
+				require.Error(t, err)
+			} else {
+				require.NoError(t, err)
+			}
+		})
+	}
+}
+
+func Test_genFilePath(t *testing.T) {
+	t.Parallel()
+
+	fields := pathFields{
+		Subreddit: "wallpapers",
+		Title:     "A lake/at dawn",
+		PostID:    "abc",
+		Author:    "bob",
+		Name:      "xyz",
+		Ext:       "jpg",
+		Created:   time.Date(2024, time.March, 5, 0, 0, 0, 0, time.UTC),
+	}
+
+	tests := []struct {
+		name     string
+		template string
+		title    string
+		want     string
+		wantErr  bool
+	}{
+		{
+			name:     "default",
+			template: defaultPathTemplate,
+			title:    fields.Title,
+			want:     filepath.Join("/pics", "wallpapers_A_lake_at_dawn_xyz.jpg"),
+			wantErr:  false,
+		},
+		{
+			name:     "subdirectories",
+			template: "{subreddit}/{yyyy}/{mm}/{dd}/{title}_{id}.{ext}",
+			title:    fields.Title,
+			want:     filepath.Join("/pics", "wallpapers", "2024", "03", "05", "A_lake_at_dawn_abc.jpg"),
+			wantErr:  false,
+		},
+		{
+			name:     "long title is trimmed",
+			template: "{author}/{title}.{ext}",
+			title:    strings.Repeat("a", 300),
+			want:     filepath.Join("/pics", "bob", strings.Repeat("a", maxPathLength-len("/pics/bob/.jpg"))+".jpg"),
+			wantErr:  false,
+		},
+		{
+			name:     "too long without a title",
+			template: strings.Repeat("{name}", 100) + ".{ext}",
+			title:    fields.Title,
+			want:     "",
+			wantErr:  true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			f := fields
+			f.Title = tt.title
+			got, err := genFilePath("/pics", tt.template, sanitizePosix, f)
+			if tt.wantErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tt.want, got)
+			require.LessOrEqual(t, len(got), maxPathLength)
+		})
+	}
+}
@@ -0,0 +1,434 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"io"
+	"io/fs"
+	"math"
+	"math/bits"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// Perceptual hash algorithms
+const (
+	perceptualNone  = "none"
+	perceptualAHash = "ahash"
+	perceptualDHash = "dhash"
+	perceptualPHash = "phash"
+)
+
+// What to do with a downloaded image that near-matches one in the destination or history
+const (
+	nearDuplicatesReject     = "reject"
+	nearDuplicatesKeepLarger = "keep-larger"
+)
+
+// perceptualHash is a 64 bit image fingerprint. Similar looking images have
+// hashes a small Hamming distance apart
+type perceptualHash struct {
+	Algorithm string
+	Hash      uint64
+}
+
+// String formats the hash as "<algorithm>:<hex>" for the history file
+func (p perceptualHash) String() string {
+	return fmt.Sprintf("%s:%016x", p.Algorithm, p.Hash)
+}
+
+func parsePerceptualHash(s string) (perceptualHash, error) {
+	algorithm, hex, found := strings.Cut(s, ":")
+	if !found {
+		return perceptualHash{}, errors.Errorf("invalid perceptual hash: %#v", s)
+	}
+	hash, err := strconv.ParseUint(hex, 16, 64)
+	if err != nil {
+		return perceptualHash{}, errors.Wrapf(err, "invalid perceptual hash: %#v", s)
+	}
+	return perceptualHash{Algorithm: algorithm, Hash: hash}, nil
+}
+
+// distance returns the Hamming distance between two hashes from the same algorithm
+func (p perceptualHash) distance(o perceptualHash) int {
+	return bits.OnesCount64(p.Hash ^ o.Hash)
+}
+
+// grayscaleThumbnail shrinks img to width x height luminance values by
+// averaging (a sample of) the pixels in each box
+func grayscaleThumbnail(img image.Image, width int, height int) [][]float64 {
+	bounds := img.Bounds()
+	ret := make([][]float64, height)
+	for y := 0; y < height; y++ {
+		ret[y] = make([]float64, width)
+		y0 := bounds.Min.Y + y*bounds.Dy()/height
+		y1 := max(bounds.Min.Y+(y+1)*bounds.Dy()/height, y0+1)
+		for x := 0; x < width; x++ {
+			x0 := bounds.Min.X + x*bounds.Dx()/width
+			x1 := max(bounds.Min.X+(x+1)*bounds.Dx()/width, x0+1)
+			// sampling big boxes keeps hashing a 40 megapixel image fast
+			stepX := max((x1-x0)/16, 1)
+			stepY := max((y1-y0)/16, 1)
+			sum := 0.0
+			n := 0
+			for py := y0; py < y1; py += stepY {
+				for px := x0; px < x1; px += stepX {
+					r, g, b, _ := img.At(px, py).RGBA()
+					sum += 0.299*float64(r) + 0.587*float64(g) + 0.114*float64(b)
+					n++
+				}
+			}
+			ret[y][x] = sum / float64(n)
+		}
+	}
+	return ret
+}
+
+func aHash(img image.Image) uint64 {
+	thumb := grayscaleThumbnail(img, 8, 8)
+	mean := 0.0
+	for _, row := range thumb {
+		for _, v := range row {
+			mean += v
+		}
+	}
+	mean /= 64
+	var hash uint64
+	for _, row := range thumb {
+		for _, v := range row {
+			hash <<= 1
+			if v > mean {
+				hash |= 1
+			}
+		}
+	}
+	return hash
+}
+
+func dHash(img image.Image) uint64 {
+	thumb := grayscaleThumbnail(img, 9, 8)
+	var hash uint64
+	for _, row := range thumb {
+		for x := 0; x < 8; x++ {
+			hash <<= 1
+			if row[x] < row[x+1] {
+				hash |= 1
+			}
+		}
+	}
+	return hash
+}
+
+// dct1D is an unnormalized DCT-II, which is all pHash needs to compare coefficients
+func dct1D(in []float64) []float64 {
+	n := len(in)
+	out := make([]float64, n)
+	for k := 0; k < n; k++ {
+		sum := 0.0
+		for i, v := range in {
+			sum += v * math.Cos(math.Pi/float64(n)*(float64(i)+0.5)*float64(k))
+		}
+		out[k] = sum
+	}
+	return out
+}
+
+func pHash(img image.Image) uint64 {
+	const size = 32
+	thumb := grayscaleThumbnail(img, size, size)
+
+	// 2D DCT: rows, then columns
+	rows := make([][]float64, size)
+	for y := range thumb {
+		rows[y] = dct1D(thumb[y])
+	}
+	coefficients := make([][]float64, size)
+	for y := range coefficients {
+		coefficients[y] = make([]float64, size)
+	}
+	col := make([]float64, size)
+	for x := 0; x < size; x++ {
+		for y := 0; y < size; y++ {
+			col[y] = rows[y][x]
+		}
+		out := dct1D(col)
+		for y := 0; y < size; y++ {
+			coefficients[y][x] = out[y]
+		}
+	}
+
+	// compare the lowest 8x8 frequencies to their median, leaving out the DC
+	// term because it's just the average brightness
+	low := make([]float64, 0, 64)
+	for y := 0; y < 8; y++ {
+		low = append(low, coefficients[y][:8]...)
+	}
+	sorted := append([]float64{}, low[1:]...)
+	sort.Float64s(sorted)
+	median := sorted[len(sorted)/2]
+
+	var hash uint64
+	for _, v := range low {
+		hash <<= 1
+		if v > median {
+			hash |= 1
+		}
+	}
+	return hash
+}
+
+func computePerceptualHash(img image.Image, algorithm string) (perceptualHash, error) {
+	var hash uint64
+	switch algorithm {
+	case perceptualAHash:
+		hash = aHash(img)
+	case perceptualDHash:
+		hash = dHash(img)
+	case perceptualPHash:
+		hash = pHash(img)
+	default:
+		return perceptualHash{}, errors.Errorf("unknown perceptual hash algorithm: %#v", algorithm)
+	}
+	return perceptualHash{Algorithm: algorithm, Hash: hash}, nil
+}
+
+// hashImageFile decodes an image file and returns its perceptual hash and dimensions
+func hashImageFile(filePath string, algorithm string) (perceptualHash, image.Point, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return perceptualHash{}, image.Point{}, errors.WithStack(err)
+	}
+	defer file.Close()
+
+	img, _, err := image.Decode(file)
+	if err != nil {
+		return perceptualHash{}, image.Point{}, errors.Wrapf(err, "could not decode image: %#v", filePath)
+	}
+	hash, err := computePerceptualHash(img, algorithm)
+	if err != nil {
+		return perceptualHash{}, image.Point{}, err
+	}
+	return hash, img.Bounds().Size(), nil
+}
+
+// imageSize returns the dimensions of an image file without decoding all of it
+func imageSize(filePath string) (image.Point, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return image.Point{}, errors.WithStack(err)
+	}
+	defer file.Close()
+
+	config, _, err := image.DecodeConfig(file)
+	if err != nil {
+		return image.Point{}, errors.Wrapf(err, "could not decode image dimensions: %#v", filePath)
+	}
+	return image.Point{X: config.Width, Y: config.Height}, nil
+}
+
+// perceptualEntry is an indexed image. FilePath may no longer exist if the
+// entry came from history
+type perceptualEntry struct {
+	Hash     perceptualHash
+	FilePath string
+}
+
+// perceptualIndex finds near-duplicate images in destination directories and history
+type perceptualIndex struct {
+	mu        sync.Mutex
+	algorithm string
+	threshold int
+	// scans are the destination directories scanned or being scanned
+	scans   map[string]*perceptualScan
+	entries []perceptualEntry
+}
+
+// perceptualScan is the scan of a destination directory
+type perceptualScan struct {
+	// ready is closed once the directory is scanned
+	ready chan struct{}
+	err   error
+}
+
+// newPerceptualIndex indexes the history entries hashed with algorithm
+func newPerceptualIndex(algorithm string, threshold int, h *history) *perceptualIndex {
+	p := &perceptualIndex{
+		mu:        sync.Mutex{},
+		algorithm: algorithm,
+		threshold: threshold,
+		scans:     make(map[string]*perceptualScan),
+		entries:   nil,
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, e := range h.entries {
+		if e.PerceptualHash == "" {
+			continue
+		}
+		hash, err := parsePerceptualHash(e.PerceptualHash)
+		if err != nil || hash.Algorithm != algorithm {
+			continue
+		}
+		p.entries = append(p.entries, perceptualEntry{Hash: hash, FilePath: e.FilePath})
+	}
+	return p
+}
+
+// scan hashes the images under dir that aren't in indexed, except skip.
+// Decoding is slow, so it's called without mu held
+func (p *perceptualIndex) scan(dir string, skip string, indexed map[string]bool) ([]perceptualEntry, error) {
+	var entries []perceptualEntry
+	err := filepath.WalkDir(dir, func(filePath string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() || !isImageFile(d.Name()) || filePath == skip || indexed[filePath] {
+			return nil
+		}
+		hash, _, err := hashImageFile(filePath, p.algorithm)
+		if err != nil {
+			// not fatal: a corrupt or concurrently removed file can't be a duplicate
+			return nil
+		}
+		entries = append(entries, perceptualEntry{Hash: hash, FilePath: filePath})
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "could not scan destination: %#v", dir)
+	}
+	return entries, nil
+}
+
+// index scans dir the first time it's used. Other callers wait for that scan
+func (p *perceptualIndex) index(dir string, skip string) error {
+	p.mu.Lock()
+	s, ok := p.scans[dir]
+	if ok {
+		p.mu.Unlock()
+		<-s.ready
+		return s.err
+	}
+	s = &perceptualScan{ready: make(chan struct{}), err: nil}
+	p.scans[dir] = s
+	indexed := make(map[string]bool, len(p.entries))
+	for _, e := range p.entries {
+		indexed[e.FilePath] = true
+	}
+	p.mu.Unlock()
+
+	entries, err := p.scan(dir, skip, indexed)
+
+	p.mu.Lock()
+	p.entries = append(p.entries, entries...)
+	s.err = err
+	p.mu.Unlock()
+	close(s.ready)
+	return err
+}
+
+// lookupOrAdd returns the closest indexed image within the threshold of
+// hash. If there isn't one, filePath is added to the index
+func (p *perceptualIndex) lookupOrAdd(dir string, hash perceptualHash, filePath string) (perceptualEntry, bool, error) {
+	err := p.index(dir, filePath)
+	if err != nil {
+		return perceptualEntry{}, false, err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	best := -1
+	for i, e := range p.entries {
+		if e.FilePath == filePath {
+			continue
+		}
+		d := e.Hash.distance(hash)
+		if d <= p.threshold && (best == -1 || d < p.entries[best].Hash.distance(hash)) {
+			best = i
+		}
+	}
+	if best != -1 {
+		return p.entries[best], true, nil
+	}
+	p.entries = append(p.entries, perceptualEntry{Hash: hash, FilePath: filePath})
+	return perceptualEntry{}, false, nil
+}
+
+// replace points an index entry at a new file and hash, used when a larger near-duplicate replaces it
+func (p *perceptualIndex) replace(oldFilePath string, hash perceptualHash, newFilePath string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for i, e := range p.entries {
+		if e.FilePath == oldFilePath {
+			p.entries[i] = perceptualEntry{Hash: hash, FilePath: newFilePath}
+			return
+		}
+	}
+	p.entries = append(p.entries, perceptualEntry{Hash: hash, FilePath: newFilePath})
+}
+
+// nearDuplicateGroup is a set of images within the threshold of the first
+type nearDuplicateGroup struct {
+	Keep       string
+	Duplicates []string
+}
+
+// findNearDuplicates hashes the images under dir and groups near-duplicates.
+// Each group keeps its highest resolution image. Images that can't be decoded
+// are skipped and reported to w
+func findNearDuplicates(dir string, algorithm string, threshold int, w io.Writer) ([]nearDuplicateGroup, error) {
+	type hashedFile struct {
+		FilePath string
+		Hash     perceptualHash
+		Pixels   int
+	}
+	var files []hashedFile
+	err := filepath.WalkDir(dir, func(filePath string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() || !isImageFile(d.Name()) {
+			return nil
+		}
+		hash, size, err := hashImageFile(filePath, algorithm)
+		if err != nil {
+			fmt.Fprintf(w, "Skipping image: %s\n", err)
+			return nil
+		}
+		files = append(files, hashedFile{FilePath: filePath, Hash: hash, Pixels: size.X * size.Y})
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "could not scan directory: %#v", dir)
+	}
+
+	// largest first, so each group keeps its first member
+	sort.SliceStable(files, func(i, j int) bool {
+		return files[i].Pixels > files[j].Pixels
+	})
+
+	grouped := make([]bool, len(files))
+	groups := []nearDuplicateGroup{}
+	for i := range files {
+		if grouped[i] {
+			continue
+		}
+		group := nearDuplicateGroup{Keep: files[i].FilePath, Duplicates: nil}
+		for j := i + 1; j < len(files); j++ {
+			if !grouped[j] && files[i].Hash.distance(files[j].Hash) <= threshold {
+				grouped[j] = true
+				group.Duplicates = append(group.Duplicates, files[j].FilePath)
+			}
+		}
+		if len(group.Duplicates) > 0 {
+			groups = append(groups, group)
+		}
+	}
+	return groups, nil
+}
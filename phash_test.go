@@ -0,0 +1,84 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/png"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// testLandscape draws a scene with a bright sky, a dark mountain, and a
+// diagonal ridge so the hashes have structure to find. flip mirrors it
+func testLandscape(width int, height int, flip bool) image.Image {
+	img := image.NewGray(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			fx := float64(x) / float64(width)
+			if flip {
+				fx = 1 - fx
+			}
+			fy := float64(y) / float64(height)
+			v := 230 - 120*fy
+			if fy > 0.3+0.4*fx {
+				v = 40 + 60*fx
+			}
+			img.SetGray(x, y, color.Gray{Y: uint8(v)})
+		}
+	}
+	return img
+}
+
+func writePNG(t *testing.T, filePath string, img image.Image) {
+	t.Helper()
+	file, err := os.Create(filePath)
+	require.NoError(t, err)
+	defer file.Close()
+	require.NoError(t, png.Encode(file, img))
+}
+
+func TestPerceptualHash(t *testing.T) {
+	t.Parallel()
+
+	for _, algorithm := range []string{perceptualAHash, perceptualDHash, perceptualPHash} {
+		t.Run(algorithm, func(t *testing.T) {
+			original, err := computePerceptualHash(testLandscape(640, 360, false), algorithm)
+			require.NoError(t, err)
+			resized, err := computePerceptualHash(testLandscape(1920, 1080, false), algorithm)
+			require.NoError(t, err)
+			flipped, err := computePerceptualHash(testLandscape(640, 360, true), algorithm)
+			require.NoError(t, err)
+
+			require.LessOrEqual(t, original.distance(resized), 5)
+			require.Greater(t, original.distance(flipped), 5)
+
+			parsed, err := parsePerceptualHash(original.String())
+			require.NoError(t, err)
+			require.Equal(t, original, parsed)
+		})
+	}
+}
+
+func Test_findNearDuplicates(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	small := filepath.Join(dir, "small.png")
+	large := filepath.Join(dir, "large.png")
+	other := filepath.Join(dir, "other.png")
+	writePNG(t, small, testLandscape(320, 180, false))
+	writePNG(t, large, testLandscape(960, 540, false))
+	writePNG(t, other, testLandscape(320, 180, true))
+	corrupt := filepath.Join(dir, "corrupt.png")
+	require.NoError(t, os.WriteFile(corrupt, []byte("not a png"), 0600))
+
+	var skipped bytes.Buffer
+	groups, err := findNearDuplicates(dir, perceptualDHash, 5, &skipped)
+	require.NoError(t, err)
+	require.Equal(t, []nearDuplicateGroup{{Keep: large, Duplicates: []string{small}}}, groups)
+	require.Contains(t, skipped.String(), corrupt)
+}
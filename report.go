@@ -0,0 +1,262 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Formats for --report
+const (
+	reportNone = "none"
+	reportJSON = "json"
+)
+
+// Reasons an image was skipped, in addition to the dry run decisions
+// decisionExists, decisionInHistory, decisionSkippedNSFW, decisionSkippedFlair,
+// decisionBadURL, and decisionTooLongPath
+const (
+	skipRejected      = "rejected"
+	skipDuplicate     = "duplicate"
+	skipNearDuplicate = "near-duplicate"
+	skipTooLarge      = "too-large"
+	// skipCancelled is a download aborted because the run was cancelled
+	skipCancelled = "cancelled"
+	// skipOutOfTime is a download aborted because --max-run-time or the subreddit's timebudget ran out
+	skipOutOfTime = "out-of-time"
+)
+
+// reportFile is a file written by grab
+type reportFile struct {
+	Path   string `json:"path"`
+	URL    string `json:"url"`
+	PostID string `json:"post_id"`
+	Bytes  int64  `json:"bytes"`
+	SHA256 string `json:"sha256"`
+}
+
+// subredditReport counts what happened to one --subreddit-info entry. It's
+// updated concurrently by the entry's downloads
+type subredditReport struct {
+	mu        sync.Mutex
+	Subreddit string `json:"subreddit"`
+	Sort      string `json:"sort"`
+	Timeframe string `json:"timeframe,omitempty"`
+	// Fetched is the number of posts returned by Reddit
+	Fetched    int            `json:"fetched"`
+	Downloaded int            `json:"downloaded"`
+	Skipped    map[string]int `json:"skipped"`
+	Failed     int            `json:"failed"`
+	Bytes      int64          `json:"bytes"`
+	// Error is set if the subreddit couldn't be used at all
+	Error string `json:"error,omitempty"`
+	// OutOfTime is set if the subreddit's time budget or --max-run-time ran
+	// out. Remaining is how many more images it needed
+	OutOfTime       bool         `json:"out_of_time,omitempty"`
+	Remaining       int          `json:"remaining,omitempty"`
+	DurationSeconds float64      `json:"duration_seconds"`
+	Files           []reportFile `json:"files"`
+	start           time.Time
+}
+
+func (r *subredditReport) begin() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.start = time.Now()
+}
+
+func (r *subredditReport) end() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.DurationSeconds = time.Since(r.start).Seconds()
+}
+
+// fetched adds a page of posts to the count
+func (r *subredditReport) fetched(count int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.Fetched += count
+}
+
+// failSubreddit records that the subreddit's posts couldn't be fetched
+func (r *subredditReport) failSubreddit(err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.Failed++
+	r.Error = err.Error()
+}
+
+// outOfTime records that the subreddit's remaining images were skipped.
+// Downloads already aborted by the deadline are part of remaining, so they
+// aren't counted twice
+func (r *subredditReport) outOfTime(remaining int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.OutOfTime = true
+	r.Remaining = max(remaining, 0)
+	r.Skipped[skipOutOfTime] = max(r.Skipped[skipOutOfTime], r.Remaining)
+}
+
+func (r *subredditReport) fail() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.Failed++
+}
+
+func (r *subredditReport) skip(reason string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.Skipped[reason]++
+}
+
+func (r *subredditReport) downloaded(file reportFile) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.Downloaded++
+	r.Bytes += file.Bytes
+	r.Files = append(r.Files, file)
+}
+
+// runReport summarizes a grab run for --report
+type runReport struct {
+	StartTime       time.Time `json:"start_time"`
+	EndTime         time.Time `json:"end_time"`
+	DurationSeconds float64   `json:"duration_seconds"`
+	DryRun          bool      `json:"dry_run"`
+	// Cancelled is set if the run was stopped by SIGINT or SIGTERM
+	Cancelled bool `json:"cancelled"`
+	// OutOfTime is set if --max-run-time ran out
+	OutOfTime bool `json:"out_of_time"`
+	// Outcome is one of the outcome* constants
+	Outcome    string             `json:"outcome"`
+	Downloaded int                `json:"downloaded"`
+	Skipped    int                `json:"skipped"`
+	Failed     int                `json:"failed"`
+	Bytes      int64              `json:"bytes"`
+	Subreddits []*subredditReport `json:"subreddits"`
+}
+
+func newRunReport(dryRun bool) *runReport {
+	return &runReport{
+		StartTime:       time.Now(),
+		EndTime:         time.Time{},
+		DurationSeconds: 0,
+		DryRun:          dryRun,
+		Cancelled:       false,
+		OutOfTime:       false,
+		Outcome:         "",
+		Downloaded:      0,
+		Skipped:         0,
+		Failed:          0,
+		Bytes:           0,
+		Subreddits:      nil,
+	}
+}
+
+// addSubreddit adds a report for a --subreddit-info entry. Call it before
+// starting the entry's goroutine
+func (r *runReport) addSubreddit(name string, sort string, timeframe string) *subredditReport {
+	sr := &subredditReport{
+		mu:              sync.Mutex{},
+		Subreddit:       name,
+		Sort:            sort,
+		Timeframe:       timeframe,
+		Fetched:         0,
+		Downloaded:      0,
+		Skipped:         make(map[string]int),
+		Failed:          0,
+		Bytes:           0,
+		Error:           "",
+		OutOfTime:       false,
+		Remaining:       0,
+		DurationSeconds: 0,
+		Files:           []reportFile{},
+		start:           time.Time{},
+	}
+	r.Subreddits = append(r.Subreddits, sr)
+	return sr
+}
+
+// finish sums the subreddit counts and sets the outcome. Call it after every subreddit is done
+func (r *runReport) finish() {
+	r.EndTime = time.Now()
+	r.DurationSeconds = r.EndTime.Sub(r.StartTime).Seconds()
+	for _, sr := range r.Subreddits {
+		r.Downloaded += sr.Downloaded
+		for _, count := range sr.Skipped {
+			r.Skipped += count
+		}
+		r.Failed += sr.Failed
+		r.Bytes += sr.Bytes
+	}
+	r.Outcome = r.outcome()
+}
+
+// stoppedEarly returns whether the run was cancelled or ran out of time,
+// overall or for any subreddit
+func (r *runReport) stoppedEarly() bool {
+	if r.Cancelled || r.OutOfTime {
+		return true
+	}
+	for _, sr := range r.Subreddits {
+		if sr.OutOfTime {
+			return true
+		}
+	}
+	return false
+}
+
+// writeSummary writes a short, human readable summary of the run
+func (r *runReport) writeSummary(w io.Writer) error {
+	_, err := fmt.Fprintf(
+		w,
+		"%s after %.1fs: %d images downloaded (%d bytes), %d skipped, %d failed\n",
+		r.Outcome, r.DurationSeconds, r.Downloaded, r.Bytes, r.Skipped, r.Failed,
+	)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	for _, sr := range r.Subreddits {
+		outOfTime := ""
+		if sr.OutOfTime {
+			outOfTime = fmt.Sprintf(", out of time with %d images remaining", sr.Remaining)
+		}
+		_, err = fmt.Fprintf(w, "  %s: %d downloaded, %d failed%s\n", sr.Subreddit, sr.Downloaded, sr.Failed, outOfTime)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+	}
+	return nil
+}
+
+func (r *runReport) writeJSON(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	err := enc.Encode(r)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	return nil
+}
+
+// writeReportFile writes the report to filename, or to stdout if filename is empty
+func writeReportFile(r *runReport, filename string) error {
+	if filename == "" {
+		return r.writeJSON(os.Stdout)
+	}
+	file, err := os.Create(filename)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	err = r.writeJSON(file)
+	if err != nil {
+		file.Close()
+		return err
+	}
+	return errors.WithStack(file.Close())
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRunReport(t *testing.T) {
+	t.Parallel()
+
+	report := newRunReport(false)
+	wallpapers := report.addSubreddit("wallpapers", sortTop, "week")
+	wallpapers.begin()
+	wallpapers.fetched(3)
+	wallpapers.downloaded(reportFile{Path: "/tmp/a.jpg", URL: "https://i.redd.it/a.jpg", PostID: "a", Bytes: 100, SHA256: "aa"})
+	wallpapers.skip(decisionSkippedNSFW)
+	wallpapers.fail()
+	wallpapers.end()
+
+	earthporn := report.addSubreddit("earthporn", sortHot, "")
+	earthporn.begin()
+	earthporn.failSubreddit(errors.New("subreddit not found"))
+	earthporn.end()
+
+	report.finish()
+
+	var buf bytes.Buffer
+	require.NoError(t, report.writeJSON(&buf))
+
+	var decoded struct {
+		Downloaded int   `json:"downloaded"`
+		Skipped    int   `json:"skipped"`
+		Failed     int   `json:"failed"`
+		Bytes      int64 `json:"bytes"`
+		Subreddits []struct {
+			Subreddit string         `json:"subreddit"`
+			Fetched   int            `json:"fetched"`
+			Skipped   map[string]int `json:"skipped"`
+			Error     string         `json:"error"`
+			Files     []reportFile   `json:"files"`
+		} `json:"subreddits"`
+	}
+	require.NoError(t, json.Unmarshal(buf.Bytes(), &decoded))
+
+	require.Equal(t, 1, decoded.Downloaded)
+	require.Equal(t, 1, decoded.Skipped)
+	require.Equal(t, 2, decoded.Failed)
+	require.Equal(t, int64(100), decoded.Bytes)
+	require.Len(t, decoded.Subreddits, 2)
+	require.Equal(t, 3, decoded.Subreddits[0].Fetched)
+	require.Equal(t, map[string]int{decisionSkippedNSFW: 1}, decoded.Subreddits[0].Skipped)
+	require.Equal(t, "/tmp/a.jpg", decoded.Subreddits[0].Files[0].Path)
+	require.Equal(t, "subreddit not found", decoded.Subreddits[1].Error)
+}
+
+func TestRunReport_writeSummary(t *testing.T) {
+	t.Parallel()
+
+	report := newRunReport(false)
+	wallpapers := report.addSubreddit("wallpapers", sortTop, "week")
+	wallpapers.downloaded(reportFile{Path: "/tmp/a.jpg", URL: "https://i.redd.it/a.jpg", PostID: "a", Bytes: 100, SHA256: "aa"})
+	wallpapers.skip(skipCancelled)
+	earthporn := report.addSubreddit("earthporn", sortHot, "")
+	// the aborted download is one of the remaining images
+	earthporn.skip(skipOutOfTime)
+	earthporn.outOfTime(3)
+	report.Cancelled = true
+	report.finish()
+	report.DurationSeconds = 2
+
+	var buf bytes.Buffer
+	require.NoError(t, report.writeSummary(&buf))
+	want := "cancelled after 2.0s: 1 images downloaded (100 bytes), 4 skipped, 0 failed\n" +
+		"  wallpapers: 1 downloaded, 0 failed\n" +
+		"  earthporn: 0 downloaded, 0 failed, out of time with 3 images remaining\n"
+	require.Equal(t, want, buf.String())
+}
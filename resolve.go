@@ -0,0 +1,191 @@
+package main
+
+import (
+	"context"
+	"net/url"
+	"path"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/vartanbeno/go-reddit/v2/reddit"
+)
+
+// Resolver names, used to enable or disable resolvers per subreddit
+const (
+	resolverDirect  = "direct"
+	resolverIReddit = "i.redd.it"
+	resolverPreview = "preview.redd.it"
+	resolverGallery = "gallery"
+	resolverImgur   = "imgur"
+)
+
+// nolint: gochecknoglobals // readonly map used for validation
+var validResolverNames = map[string]bool{
+	resolverDirect:  true,
+	resolverIReddit: true,
+	resolverPreview: true,
+	resolverGallery: true,
+	resolverImgur:   true,
+}
+
+// imageCandidate is a downloadable image found in a post
+type imageCandidate struct {
+	URL string
+	// Name is the suggested file name, without extension
+	Name string
+	// Ext is the file extension, including the leading dot
+	Ext string
+}
+
+// newImageCandidate splits urlFileName into the candidate's name and extension
+func newImageCandidate(imageURL string, urlFileName string) imageCandidate {
+	ext := path.Ext(urlFileName)
+	return imageCandidate{
+		URL:  imageURL,
+		Name: strings.TrimSuffix(urlFileName, ext),
+		Ext:  ext,
+	}
+}
+
+func (c imageCandidate) FileName() string {
+	return c.Name + c.Ext
+}
+
+// Resolver finds downloadable images in posts from a particular image host
+type Resolver interface {
+	// Name identifies the resolver in config
+	Name() string
+	// Matches reports whether the resolver handles the post
+	Matches(post *reddit.Post) bool
+	// Resolve returns the images in a post the resolver Matches
+	Resolve(ctx context.Context, post *reddit.Post) ([]imageCandidate, error)
+}
+
+// resolverRegistry holds resolvers in the order they're tried
+type resolverRegistry struct {
+	resolvers []Resolver
+}
+
+func newResolverRegistry(resolvers ...Resolver) *resolverRegistry {
+	return &resolverRegistry{resolvers: resolvers}
+}
+
+// enabled returns the registered resolvers in enable (all if enable is
+// empty) that aren't in disable
+func (r *resolverRegistry) enabled(enable []string, disable []string) []Resolver {
+	inList := func(name string, list []string) bool {
+		for _, n := range list {
+			if n == name {
+				return true
+			}
+		}
+		return false
+	}
+	ret := []Resolver{}
+	for _, resolver := range r.resolvers {
+		name := resolver.Name()
+		if len(enable) > 0 && !inList(name, enable) {
+			continue
+		}
+		if inList(name, disable) {
+			continue
+		}
+		ret = append(ret, resolver)
+	}
+	return ret
+}
+
+// resolvePost returns the images from the first resolver that matches the post
+func resolvePost(ctx context.Context, resolvers []Resolver, post *reddit.Post) ([]imageCandidate, error) {
+	for _, resolver := range resolvers {
+		if resolver.Matches(post) {
+			candidates, err := resolver.Resolve(ctx, post)
+			if err != nil {
+				return nil, errors.Wrapf(err, "%s resolver failed", resolver.Name())
+			}
+			return candidates, nil
+		}
+	}
+	return nil, errors.Errorf("no resolver for URL: %#v", post.URL)
+}
+
+func urlHost(fullURL string) string {
+	u, err := url.Parse(fullURL)
+	if err != nil {
+		return ""
+	}
+	return strings.ToLower(u.Hostname())
+}
+
+// directResolver downloads links to .jpg, .jpeg and .png files on hosts
+// without a more specific resolver
+type directResolver struct{}
+
+func (directResolver) Name() string {
+	return resolverDirect
+}
+
+func (directResolver) Matches(post *reddit.Post) bool {
+	switch urlHost(post.URL) {
+	case "i.redd.it", "preview.redd.it":
+		return false
+	}
+	_, err := validateImageURL(post.URL)
+	return err == nil
+}
+
+func (directResolver) Resolve(_ context.Context, post *reddit.Post) ([]imageCandidate, error) {
+	urlFileName, err := validateImageURL(post.URL)
+	if err != nil {
+		return nil, err
+	}
+	return []imageCandidate{newImageCandidate(post.URL, urlFileName)}, nil
+}
+
+// iRedditResolver downloads images hosted on i.redd.it
+type iRedditResolver struct{}
+
+func (iRedditResolver) Name() string {
+	return resolverIReddit
+}
+
+func (iRedditResolver) Matches(post *reddit.Post) bool {
+	if urlHost(post.URL) != "i.redd.it" {
+		return false
+	}
+	_, err := validateImageURL(post.URL)
+	return err == nil
+}
+
+func (iRedditResolver) Resolve(_ context.Context, post *reddit.Post) ([]imageCandidate, error) {
+	urlFileName, err := validateImageURL(post.URL)
+	if err != nil {
+		return nil, err
+	}
+	return []imageCandidate{newImageCandidate(post.URL, urlFileName)}, nil
+}
+
+// previewResolver downloads the original of a preview.redd.it image. Preview
+// URLs point to resized copies and need a signed query string, but the same
+// file name on i.redd.it is the full size image
+type previewResolver struct{}
+
+func (previewResolver) Name() string {
+	return resolverPreview
+}
+
+func (previewResolver) Matches(post *reddit.Post) bool {
+	if urlHost(post.URL) != "preview.redd.it" {
+		return false
+	}
+	_, err := validateImageURL(post.URL)
+	return err == nil
+}
+
+func (previewResolver) Resolve(_ context.Context, post *reddit.Post) ([]imageCandidate, error) {
+	urlFileName, err := validateImageURL(post.URL)
+	if err != nil {
+		return nil, err
+	}
+	return []imageCandidate{newImageCandidate("https://i.redd.it/"+urlFileName, urlFileName)}, nil
+}
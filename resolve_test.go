@@ -0,0 +1,95 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/vartanbeno/go-reddit/v2/reddit"
+)
+
+func Test_resolvePost(t *testing.T) {
+	t.Parallel()
+
+	registry := newResolverRegistry(
+		iRedditResolver{},
+		previewResolver{},
+		directResolver{},
+	)
+
+	tests := []struct {
+		name    string
+		url     string
+		disable []string
+		want    []imageCandidate
+		wantErr bool
+	}{
+		{
+			name:    "direct",
+			url:     "https://example.com/img.jpeg?abc=def",
+			disable: nil,
+			want:    []imageCandidate{{URL: "https://example.com/img.jpeg?abc=def", Name: "img", Ext: ".jpeg"}},
+			wantErr: false,
+		},
+		{
+			name:    "i.redd.it",
+			url:     "https://i.redd.it/abc.png",
+			disable: nil,
+			want:    []imageCandidate{{URL: "https://i.redd.it/abc.png", Name: "abc", Ext: ".png"}},
+			wantErr: false,
+		},
+		{
+			name:    "preview.redd.it",
+			url:     "https://preview.redd.it/abc.jpg?width=640&s=sig",
+			disable: nil,
+			want:    []imageCandidate{{URL: "https://i.redd.it/abc.jpg", Name: "abc", Ext: ".jpg"}},
+			wantErr: false,
+		},
+		{
+			name:    "disabled i.redd.it isn't picked up by direct",
+			url:     "https://i.redd.it/abc.png",
+			disable: []string{resolverIReddit},
+			want:    nil,
+			wantErr: true,
+		},
+		{
+			name:    "no resolver",
+			url:     "https://example.com/hellodarknessmyoldfriend",
+			disable: nil,
+			want:    nil,
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resolvers := registry.enabled(nil, tt.disable)
+			got, err := resolvePost(t.Context(), resolvers, &reddit.Post{URL: tt.url})
+			if tt.wantErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestResolverRegistry_enabled(t *testing.T) {
+	t.Parallel()
+
+	registry := newResolverRegistry(
+		iRedditResolver{},
+		previewResolver{},
+		directResolver{},
+	)
+	names := func(resolvers []Resolver) []string {
+		ret := []string{}
+		for _, r := range resolvers {
+			ret = append(ret, r.Name())
+		}
+		return ret
+	}
+
+	require.Equal(t, []string{resolverIReddit, resolverPreview, resolverDirect}, names(registry.enabled(nil, nil)))
+	require.Equal(t, []string{resolverIReddit, resolverDirect}, names(registry.enabled([]string{resolverDirect, resolverIReddit}, nil)))
+	require.Equal(t, []string{resolverIReddit}, names(registry.enabled([]string{resolverDirect, resolverIReddit}, []string{resolverDirect})))
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Interrupted downloads are kept as partial files next to their destination,
+// with metadata to resume them with a Range request
+const (
+	partialFileSuffix = ".part"
+	partialMetaSuffix = ".part.json"
+	// partialMaxAge is how long partial files are kept for a download that's never retried
+	partialMaxAge = 7 * 24 * time.Hour
+	// maxResumeAttempts is how many times downloadImage resumes an interrupted
+	// download before giving up. The partial file is kept for the next run
+	maxResumeAttempts = 3
+)
+
+func isPartialFile(name string) bool {
+	return strings.HasPrefix(name, tempFilePrefix) &&
+		(strings.HasSuffix(name, partialFileSuffix) || strings.HasSuffix(name, partialMetaSuffix))
+}
+
+// partialMeta describes a partial file
+type partialMeta struct {
+	URL string `json:"url"`
+	// ETag and LastModified are from the response that started the download.
+	// They're sent in If-Range, so a changed image is downloaded again
+	ETag         string `json:"etag,omitempty"`
+	LastModified string `json:"last_modified,omitempty"`
+	// Bytes is how much of the image the partial file has
+	Bytes int64 `json:"bytes"`
+}
+
+// validator returns the If-Range value for resuming, or "" if the download can't be resumed safely
+func (m partialMeta) validator() string {
+	if m.ETag != "" && !strings.HasPrefix(m.ETag, "W/") {
+		return m.ETag
+	}
+	return m.LastModified
+}
+
+// partialFile is where an interrupted download of a file is kept. The
+// names are hashed so they stay short however long the file name is
+type partialFile struct {
+	DataPath string
+	MetaPath string
+}
+
+func newPartialFile(fileName string) partialFile {
+	sum := sha256.Sum256([]byte(filepath.Base(fileName)))
+	base := filepath.Join(filepath.Dir(fileName), tempFilePrefix+hex.EncodeToString(sum[:8]))
+	return partialFile{
+		DataPath: base + partialFileSuffix,
+		MetaPath: base + partialMetaSuffix,
+	}
+}
+
+// load returns the partial download of URL, if there's one that can be resumed
+func (p partialFile) load(URL string) (partialMeta, bool) {
+	var meta partialMeta
+	content, err := os.ReadFile(p.MetaPath)
+	if err != nil {
+		return meta, false
+	}
+	err = json.Unmarshal(content, &meta)
+	if err != nil || meta.URL != URL || meta.validator() == "" {
+		return meta, false
+	}
+	info, err := os.Stat(p.DataPath)
+	if err != nil {
+		return meta, false
+	}
+	if meta.Bytes == 0 {
+		// grabbit was killed before it could record how much it downloaded
+		meta.Bytes = info.Size()
+	}
+	if meta.Bytes <= 0 || info.Size() != meta.Bytes {
+		return meta, false
+	}
+	return meta, true
+}
+
+func (p partialFile) save(meta partialMeta) error {
+	content, err := json.Marshal(meta)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	return errors.WithStack(os.WriteFile(p.MetaPath, content, 0600))
+}
+
+func (p partialFile) remove() {
+	_ = os.Remove(p.DataPath)
+	_ = os.Remove(p.MetaPath)
+}
+
+// newPartialMeta starts the metadata for a download from its response
+func newPartialMeta(URL string, header http.Header) partialMeta {
+	return partialMeta{
+		URL:          URL,
+		ETag:         header.Get("ETag"),
+		LastModified: header.Get("Last-Modified"),
+		Bytes:        0,
+	}
+}
+
+// parseContentRange parses a 206 response's Content-Range. total is -1 if the server doesn't know it
+// parseContentRange("bytes 100-199/200") -> 100, 200, nil
+func parseContentRange(contentRange string) (int64, int64, error) {
+	rest, found := strings.CutPrefix(contentRange, "bytes ")
+	if !found {
+		return 0, 0, errors.Errorf("invalid Content-Range: %#v", contentRange)
+	}
+	byteRange, totalStr, found := strings.Cut(rest, "/")
+	if !found {
+		return 0, 0, errors.Errorf("invalid Content-Range: %#v", contentRange)
+	}
+	startStr, _, found := strings.Cut(byteRange, "-")
+	if !found {
+		return 0, 0, errors.Errorf("invalid Content-Range: %#v", contentRange)
+	}
+	start, err := strconv.ParseInt(startStr, 10, 64)
+	if err != nil {
+		return 0, 0, errors.Errorf("invalid Content-Range: %#v", contentRange)
+	}
+	if totalStr == "*" {
+		return start, -1, nil
+	}
+	total, err := strconv.ParseInt(totalStr, 10, 64)
+	if err != nil {
+		return 0, 0, errors.Errorf("invalid Content-Range: %#v", contentRange)
+	}
+	return start, total, nil
+}
@@ -0,0 +1,313 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"image"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// largeImage returns a PNG padded past headerPeekSize, so connections can be cut after the header is checked
+func largeImage(t *testing.T) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	require.NoError(t, png.Encode(&buf, image.NewGray(image.Rect(0, 0, 64, 48))))
+	buf.Write(bytes.Repeat([]byte{0xAB}, 10*headerPeekSize))
+	return buf.Bytes()
+}
+
+// cutServer serves content, cutting the first cuts responses off after
+// cutAt bytes. Without ranges, it ignores Range headers
+type cutServer struct {
+	content []byte
+	etag    string
+	cutAt   int
+	ranges  bool
+
+	mu     sync.Mutex
+	cuts   int
+	ranged []string
+}
+
+func (s *cutServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	cut := s.cuts > 0
+	if cut {
+		s.cuts--
+	}
+	if r.Header.Get("Range") != "" {
+		s.ranged = append(s.ranged, r.Header.Get("Range"))
+	}
+	s.mu.Unlock()
+
+	w.Header().Set("ETag", s.etag)
+	if cut {
+		start := 0
+		if s.ranges && r.Header.Get("Range") != "" && r.Header.Get("If-Range") == s.etag {
+			start, _ = strconv.Atoi(r.Header.Get("Range")[len("bytes=") : len(r.Header.Get("Range"))-1])
+			w.Header().Set("Content-Range", "bytes "+strconv.Itoa(start)+"-"+strconv.Itoa(len(s.content)-1)+"/"+strconv.Itoa(len(s.content)))
+			w.Header().Set("Content-Length", strconv.Itoa(len(s.content)-start))
+			w.WriteHeader(http.StatusPartialContent)
+		} else {
+			w.Header().Set("Content-Length", strconv.Itoa(len(s.content)))
+			w.WriteHeader(http.StatusOK)
+		}
+		_, _ = w.Write(s.content[start:min(start+s.cutAt, len(s.content))])
+		http.NewResponseController(w).Flush()
+		conn, _, err := http.NewResponseController(w).Hijack()
+		if err == nil {
+			conn.Close()
+		}
+		return
+	}
+	if s.ranges {
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(s.content))
+		return
+	}
+	_, _ = w.Write(s.content)
+}
+
+func (s *cutServer) rangeRequests() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string{}, s.ranged...)
+}
+
+func sha256Hex(b []byte) string {
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+func Test_downloadImage_resume(t *testing.T) {
+	t.Parallel()
+
+	content := largeImage(t)
+	cutAt := headerPeekSize + 1000
+
+	tests := []struct {
+		name       string
+		etag       string
+		ranges     bool
+		cuts       int
+		wantErr    bool
+		wantRanges []string
+	}{
+		{
+			name:       "resume after cut",
+			etag:       `"v1"`,
+			ranges:     true,
+			cuts:       1,
+			wantErr:    false,
+			wantRanges: []string{"bytes=" + strconv.Itoa(cutAt) + "-"},
+		},
+		{
+			name:       "resume after several cuts",
+			etag:       `"v1"`,
+			ranges:     true,
+			cuts:       2,
+			wantErr:    false,
+			wantRanges: []string{"bytes=" + strconv.Itoa(cutAt) + "-", "bytes=" + strconv.Itoa(2*cutAt) + "-"},
+		},
+		{
+			name:       "full download without range support",
+			etag:       `"v1"`,
+			ranges:     false,
+			cuts:       1,
+			wantErr:    false,
+			wantRanges: []string{"bytes=" + strconv.Itoa(cutAt) + "-"},
+		},
+		{
+			name:       "start over without a validator",
+			etag:       "",
+			ranges:     true,
+			cuts:       2,
+			wantErr:    false,
+			wantRanges: []string{},
+		},
+		{
+			name:       "give up after max resumes",
+			etag:       `"v1"`,
+			ranges:     true,
+			cuts:       maxResumeAttempts + 1,
+			wantErr:    true,
+			wantRanges: nil,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			handler := &cutServer{content: content, etag: tt.etag, cutAt: cutAt, ranges: tt.ranges, mu: sync.Mutex{}, cuts: tt.cuts, ranged: nil}
+			server := httptest.NewServer(handler)
+			defer server.Close()
+
+			var noFilter imageFilter
+			fileName := filepath.Join(t.TempDir(), "pano.png")
+			result, err := downloadImage(t.Context(), server.Client(), server.URL, fileName, noFilter, 0, 0)
+			if tt.wantErr {
+				require.Error(t, err)
+				require.NoFileExists(t, fileName)
+				// the partial file is kept for the next run
+				meta, resumable := newPartialFile(fileName).load(server.URL)
+				require.True(t, resumable)
+				require.Equal(t, `"v1"`, meta.ETag)
+				return
+			}
+			require.NoError(t, err)
+			if tt.wantRanges != nil {
+				require.Equal(t, tt.wantRanges, handler.rangeRequests())
+			}
+
+			written, err := os.ReadFile(fileName)
+			require.NoError(t, err)
+			require.Equal(t, content, written)
+			require.Equal(t, int64(len(content)), result.Bytes)
+			require.Equal(t, sha256Hex(content), result.SHA256)
+			// partial files are removed
+			entries, err := os.ReadDir(filepath.Dir(fileName))
+			require.NoError(t, err)
+			require.Len(t, entries, 1)
+		})
+	}
+}
+
+func Test_downloadImage_restartAfterTimeout(t *testing.T) {
+	t.Parallel()
+
+	content := largeImage(t)
+	var mu sync.Mutex
+	requests := 0
+	// no ETag or Last-Modified, so a partial download can't be resumed
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requests++
+		first := requests == 1
+		mu.Unlock()
+		if r.Header.Get("Range") != "" {
+			http.Error(w, "unexpected Range", http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(content)))
+		if !first {
+			_, _ = w.Write(content)
+			return
+		}
+		_, _ = w.Write(content[:len(content)/2])
+		http.NewResponseController(w).Flush()
+		// stall until the client times out
+		<-r.Context().Done()
+	}))
+	defer server.Close()
+
+	var noFilter imageFilter
+	fileName := filepath.Join(t.TempDir(), "pano.png")
+	// the timeout is per attempt, so the second attempt gets a full timeout
+	result, err := downloadImage(t.Context(), server.Client(), server.URL, fileName, noFilter, 0, 500*time.Millisecond)
+	require.NoError(t, err)
+	require.Equal(t, sha256Hex(content), result.SHA256)
+	mu.Lock()
+	require.Equal(t, 2, requests)
+	mu.Unlock()
+	written, err := os.ReadFile(fileName)
+	require.NoError(t, err)
+	require.Equal(t, content, written)
+}
+
+func Test_downloadImage_resumeNextRun(t *testing.T) {
+	t.Parallel()
+
+	content := largeImage(t)
+	cutAt := headerPeekSize + 1000
+	var noFilter imageFilter
+	fileName := filepath.Join(t.TempDir(), "pano.png")
+
+	// every attempt is cut off, so the run gives up
+	handler := &cutServer{content: content, etag: `"v1"`, cutAt: cutAt, ranges: true, mu: sync.Mutex{}, cuts: maxResumeAttempts + 1, ranged: nil}
+	server := httptest.NewServer(handler)
+	defer server.Close()
+	_, err := downloadImage(t.Context(), server.Client(), server.URL, fileName, noFilter, 0, 0)
+	require.Error(t, err)
+	meta, resumable := newPartialFile(fileName).load(server.URL)
+	require.True(t, resumable)
+	require.Equal(t, int64((maxResumeAttempts+1)*cutAt), meta.Bytes)
+
+	// the next run resumes where the last one stopped
+	handler.mu.Lock()
+	handler.ranged = nil
+	handler.mu.Unlock()
+	result, err := downloadImage(t.Context(), server.Client(), server.URL, fileName, noFilter, 0, 0)
+	require.NoError(t, err)
+	require.Equal(t, []string{"bytes=" + strconv.FormatInt(meta.Bytes, 10) + "-"}, handler.rangeRequests())
+	require.Equal(t, sha256Hex(content), result.SHA256)
+	written, err := os.ReadFile(fileName)
+	require.NoError(t, err)
+	require.Equal(t, content, written)
+}
+
+func Test_downloadImage_resumeChanged(t *testing.T) {
+	t.Parallel()
+
+	content := largeImage(t)
+	cutAt := headerPeekSize + 1000
+	var noFilter imageFilter
+	fileName := filepath.Join(t.TempDir(), "pano.png")
+
+	handler := &cutServer{content: content, etag: `"v1"`, cutAt: cutAt, ranges: true, mu: sync.Mutex{}, cuts: 0, ranged: nil}
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	// a partial download of an older version of the image
+	partial := newPartialFile(fileName)
+	require.NoError(t, os.WriteFile(partial.DataPath, bytes.Repeat([]byte{0x01}, cutAt), 0600))
+	require.NoError(t, partial.save(partialMeta{URL: server.URL, ETag: `"v0"`, LastModified: "", Bytes: int64(cutAt)}))
+
+	// If-Range doesn't match, so the server sends the whole image
+	result, err := downloadImage(t.Context(), server.Client(), server.URL, fileName, noFilter, 0, 0)
+	require.NoError(t, err)
+	require.Len(t, handler.rangeRequests(), 1)
+	require.Equal(t, sha256Hex(content), result.SHA256)
+	written, err := os.ReadFile(fileName)
+	require.NoError(t, err)
+	require.Equal(t, content, written)
+}
+
+func Test_parseContentRange(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		contentRange string
+		wantStart    int64
+		wantTotal    int64
+		wantErr      bool
+	}{
+		{contentRange: "bytes 100-199/200", wantStart: 100, wantTotal: 200, wantErr: false},
+		{contentRange: "bytes 0-99/*", wantStart: 0, wantTotal: -1, wantErr: false},
+		{contentRange: "bytes */200", wantStart: 0, wantTotal: 0, wantErr: true},
+		{contentRange: "items 0-1/2", wantStart: 0, wantTotal: 0, wantErr: true},
+		{contentRange: "", wantStart: 0, wantTotal: 0, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.contentRange, func(t *testing.T) {
+			t.Parallel()
+			start, total, err := parseContentRange(tt.contentRange)
+			if tt.wantErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tt.wantStart, start)
+			require.Equal(t, tt.wantTotal, total)
+		})
+	}
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"context"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// retryPolicy decides how many times and how long to wait before retrying
+// a failed HTTP request
+type retryPolicy struct {
+	// MaxRetries is the number of retries after the first attempt. 0 disables retries
+	MaxRetries int
+	BaseDelay  time.Duration
+	MaxDelay   time.Duration
+	// AttemptTimeout bounds each attempt, from sending the request to closing
+	// its body, but not the waits between attempts. 0 means no limit
+	AttemptTimeout time.Duration
+}
+
+// backoff returns the delay before the given retry (starting at 0): the
+// base delay doubled per retry, capped at MaxDelay, with up to half of it
+// randomized so concurrent requests don't retry in lockstep
+func (p retryPolicy) backoff(retry int) time.Duration {
+	delay := p.MaxDelay
+	if retry < 32 && p.BaseDelay<<retry < p.MaxDelay && p.BaseDelay<<retry > 0 {
+		delay = p.BaseDelay << retry
+	}
+	half := delay / 2
+	if half <= 0 {
+		return delay
+	}
+	return half + rand.N(half+1)
+}
+
+// retryTransport retries GET and HEAD requests that fail with a network
+// error, 408, 429, or 5xx status. It waits for Retry-After or
+// X-Ratelimit-Reset when the server sends them, and pauses when Reddit's
+// X-Ratelimit-Remaining runs out so the next request isn't rejected. Waits
+// are capped at MaxDelay so a misbehaving server can't stall the run
+type retryTransport struct {
+	Base   http.RoundTripper
+	Policy retryPolicy
+
+	mu sync.Mutex
+	// pauseUntil is set when the rate limit runs out
+	pauseUntil time.Time
+
+	// sleep is replaced in tests
+	sleep func(ctx context.Context, d time.Duration) error
+}
+
+func newRetryTransport(base http.RoundTripper, policy retryPolicy) *retryTransport {
+	return &retryTransport{
+		Base:       base,
+		Policy:     policy,
+		mu:         sync.Mutex{},
+		pauseUntil: time.Time{},
+		sleep:      sleepContext,
+	}
+}
+
+func sleepContext(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return errors.WithStack(ctx.Err())
+	case <-timer.C:
+		return nil
+	}
+}
+
+func isRetryableStatus(code int) bool {
+	switch code {
+	case http.StatusRequestTimeout,
+		http.StatusTooManyRequests,
+		http.StatusInternalServerError,
+		http.StatusBadGateway,
+		http.StatusServiceUnavailable,
+		http.StatusGatewayTimeout:
+		return true
+	default:
+		return false
+	}
+}
+
+// retryAfter returns how long the server asked us to wait, from Retry-After
+// (seconds or an HTTP date) or X-Ratelimit-Reset (seconds)
+func retryAfter(header http.Header, now time.Time) (time.Duration, bool) {
+	if value := header.Get("Retry-After"); value != "" {
+		if seconds, err := strconv.Atoi(value); err == nil && seconds >= 0 {
+			return time.Duration(seconds) * time.Second, true
+		}
+		if date, err := http.ParseTime(value); err == nil {
+			return max(date.Sub(now), 0), true
+		}
+	}
+	return rateLimitReset(header)
+}
+
+func rateLimitReset(header http.Header) (time.Duration, bool) {
+	seconds, err := strconv.ParseFloat(header.Get("X-Ratelimit-Reset"), 64)
+	if err != nil || seconds < 0 {
+		return 0, false
+	}
+	return time.Duration(seconds * float64(time.Second)), true
+}
+
+// rateLimitExhausted returns how long until Reddit's rate limit resets, if
+// no requests remain. Reddit sends X-Ratelimit-Remaining as a float like "0.0"
+func rateLimitExhausted(header http.Header) (time.Duration, bool) {
+	remaining, err := strconv.ParseFloat(header.Get("X-Ratelimit-Remaining"), 64)
+	if err != nil || remaining >= 1 {
+		return 0, false
+	}
+	return rateLimitReset(header)
+}
+
+func (t *retryTransport) pause(d time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	until := time.Now().Add(d)
+	if until.After(t.pauseUntil) {
+		t.pauseUntil = until
+	}
+}
+
+func (t *retryTransport) pauseRemaining() time.Duration {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return time.Until(t.pauseUntil)
+}
+
+func (t *retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		return t.Base.RoundTrip(req)
+	}
+	ctx := req.Context()
+
+	delay := time.Duration(0)
+	for retry := 0; ; retry++ {
+		wait := max(delay, t.pauseRemaining())
+		if wait > 0 {
+			err := t.sleep(ctx, wait)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		resp, err := t.attempt(req)
+		if resp != nil {
+			if wait, exhausted := rateLimitExhausted(resp.Header); exhausted {
+				t.pause(min(wait, t.Policy.MaxDelay))
+			}
+		}
+
+		retryable := (err != nil && ctx.Err() == nil) || (err == nil && isRetryableStatus(resp.StatusCode))
+		if !retryable || retry >= t.Policy.MaxRetries {
+			return resp, err
+		}
+
+		delay = t.Policy.backoff(retry)
+		if resp != nil {
+			if wait, ok := retryAfter(resp.Header, time.Now()); ok {
+				delay = min(wait, t.Policy.MaxDelay)
+			}
+			// drain so the connection can be reused
+			_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 64*1024))
+			resp.Body.Close()
+		}
+	}
+}
+
+// attempt sends req once, bounded by Policy.AttemptTimeout. The timeout
+// keeps running until the response body is closed
+func (t *retryTransport) attempt(req *http.Request) (*http.Response, error) {
+	if t.Policy.AttemptTimeout <= 0 {
+		return t.Base.RoundTrip(req)
+	}
+	ctx, cancel := context.WithTimeout(req.Context(), t.Policy.AttemptTimeout)
+	resp, err := t.Base.RoundTrip(req.WithContext(ctx))
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	resp.Body = cancelOnClose{ReadCloser: resp.Body, cancel: cancel}
+	return resp, nil
+}
+
+// cancelOnClose cancels an attempt's context when its body is closed
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (c cancelOnClose) Close() error {
+	err := c.ReadCloser.Close()
+	c.cancel()
+	return err
+}
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// scriptedServer replies to the nth request with the nth step. Requests past
+// the end of the script get the last step
+func scriptedServer(t *testing.T, steps []func(w http.ResponseWriter)) (*httptest.Server, func() int) {
+	t.Helper()
+	var mu sync.Mutex
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		step := steps[min(requests, len(steps)-1)]
+		requests++
+		mu.Unlock()
+		step(w)
+	}))
+	t.Cleanup(server.Close)
+	return server, func() int {
+		mu.Lock()
+		defer mu.Unlock()
+		return requests
+	}
+}
+
+func status(code int, header map[string]string) func(w http.ResponseWriter) {
+	return func(w http.ResponseWriter) {
+		for k, v := range header {
+			w.Header().Set(k, v)
+		}
+		w.WriteHeader(code)
+		_, _ = w.Write([]byte(http.StatusText(code)))
+	}
+}
+
+// resetConnection closes the connection without a response
+func resetConnection(w http.ResponseWriter) {
+	conn, _, err := http.NewResponseController(w).Hijack()
+	if err == nil {
+		conn.Close()
+	}
+}
+
+func TestRetryTransport(t *testing.T) {
+	t.Parallel()
+
+	policy := retryPolicy{MaxRetries: 3, BaseDelay: time.Second, MaxDelay: 4 * time.Second, AttemptTimeout: 0}
+
+	tests := []struct {
+		name         string
+		steps        []func(w http.ResponseWriter)
+		wantStatus   int
+		wantErr      bool
+		wantRequests int
+		// checkSleeps checks the delays the transport waited for
+		checkSleeps func(t *testing.T, sleeps []time.Duration)
+	}{
+		{
+			name:         "success",
+			steps:        []func(w http.ResponseWriter){status(http.StatusOK, nil)},
+			wantStatus:   http.StatusOK,
+			wantErr:      false,
+			wantRequests: 1,
+			checkSleeps: func(t *testing.T, sleeps []time.Duration) {
+				require.Empty(t, sleeps)
+			},
+		},
+		{
+			name: "backoff on 5xx and connection reset",
+			steps: []func(w http.ResponseWriter){
+				status(http.StatusServiceUnavailable, nil),
+				resetConnection,
+				status(http.StatusBadGateway, nil),
+				status(http.StatusOK, nil),
+			},
+			wantStatus:   http.StatusOK,
+			wantErr:      false,
+			wantRequests: 4,
+			checkSleeps: func(t *testing.T, sleeps []time.Duration) {
+				require.Len(t, sleeps, 3)
+				for i, limit := range []time.Duration{time.Second, 2 * time.Second, 4 * time.Second} {
+					require.GreaterOrEqual(t, sleeps[i], limit/2)
+					require.LessOrEqual(t, sleeps[i], limit)
+				}
+			},
+		},
+		{
+			name: "honor Retry-After",
+			steps: []func(w http.ResponseWriter){
+				status(http.StatusTooManyRequests, map[string]string{"Retry-After": "3"}),
+				status(http.StatusOK, nil),
+			},
+			wantStatus:   http.StatusOK,
+			wantErr:      false,
+			wantRequests: 2,
+			checkSleeps: func(t *testing.T, sleeps []time.Duration) {
+				require.Equal(t, []time.Duration{3 * time.Second}, sleeps)
+			},
+		},
+		{
+			name: "cap Retry-After at max delay",
+			steps: []func(w http.ResponseWriter){
+				status(http.StatusServiceUnavailable, map[string]string{"Retry-After": "86400"}),
+				status(http.StatusOK, nil),
+			},
+			wantStatus:   http.StatusOK,
+			wantErr:      false,
+			wantRequests: 2,
+			checkSleeps: func(t *testing.T, sleeps []time.Duration) {
+				require.Equal(t, []time.Duration{4 * time.Second}, sleeps)
+			},
+		},
+		{
+			name: "cap X-Ratelimit-Reset on 429 at max delay",
+			steps: []func(w http.ResponseWriter){
+				status(http.StatusTooManyRequests, map[string]string{"X-Ratelimit-Remaining": "0.0", "X-Ratelimit-Reset": "12"}),
+				status(http.StatusOK, nil),
+			},
+			wantStatus:   http.StatusOK,
+			wantErr:      false,
+			wantRequests: 2,
+			checkSleeps: func(t *testing.T, sleeps []time.Duration) {
+				require.Equal(t, []time.Duration{4 * time.Second}, sleeps)
+			},
+		},
+		{
+			name: "honor X-Ratelimit-Reset on 429",
+			steps: []func(w http.ResponseWriter){
+				status(http.StatusTooManyRequests, map[string]string{"X-Ratelimit-Reset": "2.5"}),
+				status(http.StatusOK, nil),
+			},
+			wantStatus:   http.StatusOK,
+			wantErr:      false,
+			wantRequests: 2,
+			checkSleeps: func(t *testing.T, sleeps []time.Duration) {
+				require.Equal(t, []time.Duration{2500 * time.Millisecond}, sleeps)
+			},
+		},
+		{
+			name: "give up after max retries",
+			steps: []func(w http.ResponseWriter){
+				status(http.StatusInternalServerError, nil),
+			},
+			wantStatus:   http.StatusInternalServerError,
+			wantErr:      false,
+			wantRequests: 4,
+			checkSleeps: func(t *testing.T, sleeps []time.Duration) {
+				require.Len(t, sleeps, 3)
+			},
+		},
+		{
+			name:         "give up on connection resets",
+			steps:        []func(w http.ResponseWriter){resetConnection},
+			wantStatus:   0,
+			wantErr:      true,
+			wantRequests: 4,
+			checkSleeps: func(t *testing.T, sleeps []time.Duration) {
+				require.Len(t, sleeps, 3)
+			},
+		},
+		{
+			name: "don't retry 404",
+			steps: []func(w http.ResponseWriter){
+				status(http.StatusNotFound, nil),
+			},
+			wantStatus:   http.StatusNotFound,
+			wantErr:      false,
+			wantRequests: 1,
+			checkSleeps: func(t *testing.T, sleeps []time.Duration) {
+				require.Empty(t, sleeps)
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			server, requests := scriptedServer(t, tt.steps)
+
+			// net/http silently retries requests on reused connections that
+			// were reset, so use a new connection per request
+			var noSettings httpSettings
+			base := newHTTPTransport(noSettings)
+			base.DisableKeepAlives = true
+
+			var sleeps []time.Duration
+			transport := newRetryTransport(base, policy)
+			transport.sleep = func(ctx context.Context, d time.Duration) error {
+				sleeps = append(sleeps, d)
+				return nil
+			}
+			client := &http.Client{Timeout: 0, Transport: transport, CheckRedirect: nil, Jar: nil}
+
+			resp, err := client.Get(server.URL)
+			if tt.wantErr {
+				require.Error(t, err)
+			} else {
+				require.NoError(t, err)
+				_, _ = io.Copy(io.Discard, resp.Body)
+				resp.Body.Close()
+				require.Equal(t, tt.wantStatus, resp.StatusCode)
+			}
+			require.Equal(t, tt.wantRequests, requests())
+			tt.checkSleeps(t, sleeps)
+		})
+	}
+}
+
+func TestRetryTransport_rateLimitPause(t *testing.T) {
+	t.Parallel()
+
+	server, _ := scriptedServer(t, []func(w http.ResponseWriter){
+		status(http.StatusOK, map[string]string{"X-Ratelimit-Remaining": "0.0", "X-Ratelimit-Reset": "30"}),
+		status(http.StatusOK, nil),
+	})
+
+	var noSettings httpSettings
+	transport := newRetryTransport(newHTTPTransport(noSettings), retryPolicy{MaxRetries: 0, BaseDelay: 0, MaxDelay: 10 * time.Second, AttemptTimeout: 0})
+	var slept time.Duration
+	transport.sleep = func(ctx context.Context, d time.Duration) error {
+		slept = max(slept, d)
+		return nil
+	}
+	client := &http.Client{Timeout: 0, Transport: transport, CheckRedirect: nil, Jar: nil}
+
+	for range 2 {
+		resp, err := client.Get(server.URL)
+		require.NoError(t, err)
+		resp.Body.Close()
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+	}
+	// the second request waited for the rate limit to reset, up to the max delay
+	require.Greater(t, slept, 9*time.Second)
+	require.LessOrEqual(t, slept, 10*time.Second)
+}
+
+func TestRetryTransport_attemptTimeout(t *testing.T) {
+	t.Parallel()
+
+	server, requests := scriptedServer(t, []func(w http.ResponseWriter){
+		func(w http.ResponseWriter) {
+			// slower than the attempt timeout
+			time.Sleep(500 * time.Millisecond)
+		},
+		status(http.StatusOK, nil),
+	})
+
+	var noSettings httpSettings
+	policy := retryPolicy{MaxRetries: 1, BaseDelay: time.Minute, MaxDelay: time.Minute, AttemptTimeout: 100 * time.Millisecond}
+	transport := newRetryTransport(newHTTPTransport(noSettings), policy)
+	var sleeps []time.Duration
+	transport.sleep = func(ctx context.Context, d time.Duration) error {
+		sleeps = append(sleeps, d)
+		return nil
+	}
+	client := &http.Client{Timeout: 0, Transport: transport, CheckRedirect: nil, Jar: nil}
+
+	resp, err := client.Get(server.URL)
+	require.NoError(t, err)
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusText(http.StatusOK), string(body))
+	require.Equal(t, 2, requests())
+	// the wait between attempts isn't bounded by the attempt timeout
+	require.Len(t, sleeps, 1)
+	require.Greater(t, sleeps[0], policy.AttemptTimeout)
+}
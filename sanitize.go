@@ -0,0 +1,101 @@
+package main
+
+import (
+	"runtime"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Sanitizer profiles decide which characters can appear in file names
+const (
+	// sanitizePosix replaces separators, spaces, and control characters
+	sanitizePosix = "posix"
+	// sanitizeWindowsSafe also replaces characters Windows and SMB shares
+	// reject, trims trailing dots, and avoids reserved names like CON and NUL
+	sanitizeWindowsSafe = "windows-safe"
+	// sanitizeASCIIOnly is windows-safe, and replaces each run of non-ASCII characters, like emoji, with one _
+	sanitizeASCIIOnly = "ascii-only"
+)
+
+// defaultSanitizeProfile returns the profile for the OS grabbit runs on
+func defaultSanitizeProfile() string {
+	if runtime.GOOS == "windows" {
+		return sanitizeWindowsSafe
+	}
+	return sanitizePosix
+}
+
+// windowsReservedChars can't appear in Windows file names
+const windowsReservedChars = `<>:"|?*`
+
+// nolint: gochecknoglobals // readonly map used for validation
+var windowsReservedNames = map[string]bool{
+	"CON": true, "PRN": true, "AUX": true, "NUL": true,
+	"COM1": true, "COM2": true, "COM3": true, "COM4": true, "COM5": true, "COM6": true, "COM7": true, "COM8": true, "COM9": true,
+	"LPT1": true, "LPT2": true, "LPT3": true, "LPT4": true, "LPT5": true, "LPT6": true, "LPT7": true, "LPT8": true, "LPT9": true,
+}
+
+// sanitizeField replaces the characters in a path template field that
+// profile doesn't allow with _. Fields can't contain path separators
+// sanitizeField(sanitizeWindowsSafe, "What? A lake") -> "What__A_lake"
+func sanitizeField(profile string, s string) string {
+	var b strings.Builder
+	b.Grow(len(s))
+	inNonASCII := false
+	for _, r := range s {
+		switch {
+		case r == ' ' || r == '/' || r == '\\' || unicode.IsControl(r):
+			b.WriteByte('_')
+		case profile != sanitizePosix && strings.ContainsRune(windowsReservedChars, r):
+			b.WriteByte('_')
+		case profile == sanitizeASCIIOnly && r > unicode.MaxASCII:
+			if !inNonASCII {
+				b.WriteByte('_')
+			}
+			inNonASCII = true
+			continue
+		default:
+			b.WriteRune(r)
+		}
+		inNonASCII = false
+	}
+	return b.String()
+}
+
+// sanitizeComponent fixes a whole directory or file name. "." and ".." are
+// replaced so fields can't leave the destination. Profiles other than posix
+// also trim trailing dots and prefix reserved names, which Windows doesn't allow
+func sanitizeComponent(profile string, component string) string {
+	if component == "." || component == ".." {
+		return "_"
+	}
+	if profile == sanitizePosix {
+		return component
+	}
+	component = strings.TrimRight(component, ". ")
+	if component == "" {
+		return "_"
+	}
+	base, _, _ := strings.Cut(component, ".")
+	if windowsReservedNames[strings.ToUpper(base)] {
+		return "_" + component
+	}
+	return component
+}
+
+// truncateRunes returns the longest prefix of s that's at most maxBytes
+// long, without splitting a UTF-8 encoded rune
+func truncateRunes(s string, maxBytes int) string {
+	if len(s) <= maxBytes {
+		return s
+	}
+	if maxBytes <= 0 {
+		return ""
+	}
+	cut := maxBytes
+	for cut > 0 && !utf8.RuneStart(s[cut]) {
+		cut--
+	}
+	return s[:cut]
+}
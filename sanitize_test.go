@@ -0,0 +1,167 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+	"unicode/utf8"
+
+	"github.com/stretchr/testify/require"
+)
+
+func Test_sanitizeField(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name    string
+		profile string
+		s       string
+		want    string
+	}{
+		{name: "posix separators", profile: sanitizePosix, s: "a/b\\c d", want: "a_b_c_d"},
+		{name: "posix control characters", profile: sanitizePosix, s: "a\nb\r\x00c\td", want: "a_b__c_d"},
+		{name: "posix keeps windows reserved characters", profile: sanitizePosix, s: `What? "A" <lake>: *|`, want: `What?_"A"_<lake>:_*|`},
+		{name: "posix keeps unicode", profile: sanitizePosix, s: "Café 🌄", want: "Café_🌄"},
+		{name: "windows-safe reserved characters", profile: sanitizeWindowsSafe, s: `What? "A" <lake>: *|`, want: "What___A___lake_____"},
+		{name: "windows-safe keeps unicode", profile: sanitizeWindowsSafe, s: "Café 🌄", want: "Café_🌄"},
+		{name: "ascii-only emoji", profile: sanitizeASCIIOnly, s: "Sunrise 🌄🌄 over: the lake", want: "Sunrise___over__the_lake"},
+		{name: "ascii-only accents", profile: sanitizeASCIIOnly, s: "Café", want: "Caf_"},
+		{name: "ascii-only all non-ASCII", profile: sanitizeASCIIOnly, s: "日本の山", want: "_"},
+		{name: "ascii-only invalid UTF-8", profile: sanitizeASCIIOnly, s: "a\xffb", want: "a_b"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			require.Equal(t, tt.want, sanitizeField(tt.profile, tt.s))
+		})
+	}
+}
+
+func Test_sanitizeComponent(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name      string
+		profile   string
+		component string
+		want      string
+	}{
+		{name: "posix dot", profile: sanitizePosix, component: ".", want: "_"},
+		{name: "posix dot dot", profile: sanitizePosix, component: "..", want: "_"},
+		{name: "posix trailing dots", profile: sanitizePosix, component: "wait...", want: "wait..."},
+		{name: "posix reserved name", profile: sanitizePosix, component: "CON", want: "CON"},
+		{name: "windows-safe trailing dots", profile: sanitizeWindowsSafe, component: "wait...", want: "wait"},
+		{name: "windows-safe only dots", profile: sanitizeWindowsSafe, component: "...", want: "_"},
+		{name: "windows-safe reserved name", profile: sanitizeWindowsSafe, component: "CON", want: "_CON"},
+		{name: "windows-safe reserved name any case", profile: sanitizeWindowsSafe, component: "nul", want: "_nul"},
+		{name: "windows-safe reserved name with extension", profile: sanitizeWindowsSafe, component: "com1.jpg", want: "_com1.jpg"},
+		{name: "windows-safe reserved prefix", profile: sanitizeWindowsSafe, component: "CONSOLE.jpg", want: "CONSOLE.jpg"},
+		{name: "ascii-only reserved name", profile: sanitizeASCIIOnly, component: "LPT9", want: "_LPT9"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			require.Equal(t, tt.want, sanitizeComponent(tt.profile, tt.component))
+		})
+	}
+}
+
+func Test_truncateRunes(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name     string
+		s        string
+		maxBytes int
+		want     string
+	}{
+		{name: "short", s: "lake", maxBytes: 10, want: "lake"},
+		{name: "ascii", s: "lake", maxBytes: 2, want: "la"},
+		{name: "rune boundary", s: "café", maxBytes: 5, want: "café"},
+		{name: "inside rune", s: "café", maxBytes: 4, want: "caf"},
+		{name: "inside emoji", s: "a🌄", maxBytes: 3, want: "a"},
+		{name: "zero", s: "lake", maxBytes: 0, want: ""},
+		{name: "negative", s: "lake", maxBytes: -3, want: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			require.Equal(t, tt.want, truncateRunes(tt.s, tt.maxBytes))
+		})
+	}
+}
+
+func Test_genFilePath_sanitize(t *testing.T) {
+	t.Parallel()
+
+	var fields pathFields
+	fields.Subreddit = "wallpapers"
+	fields.Name = "xyz"
+	fields.Ext = "jpg"
+
+	tests := []struct {
+		name     string
+		profile  string
+		template string
+		title    string
+		want     string
+	}{
+		{
+			name:     "windows-safe title",
+			profile:  sanitizeWindowsSafe,
+			template: defaultPathTemplate,
+			title:    `Why? "Because": it's <pretty>`,
+			want:     filepath.Join("/pics", "wallpapers_Why___Because___it's__pretty__xyz.jpg"),
+		},
+		{
+			name:     "title directory can't leave the destination",
+			profile:  sanitizePosix,
+			template: "{title}/{name}.{ext}",
+			title:    "..",
+			want:     filepath.Join("/pics", "_", "xyz.jpg"),
+		},
+		{
+			name:     "windows-safe reserved title directory",
+			profile:  sanitizeWindowsSafe,
+			template: "{title}/{name}.{ext}",
+			title:    "aux.",
+			want:     filepath.Join("/pics", "_aux", "xyz.jpg"),
+		},
+		{
+			name:     "ascii-only emoji",
+			profile:  sanitizeASCIIOnly,
+			template: defaultPathTemplate,
+			title:    "🌄 Sunrise",
+			want:     filepath.Join("/pics", "wallpapers___Sunrise_xyz.jpg"),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			f := fields
+			f.Title = tt.title
+			got, err := genFilePath("/pics", tt.template, tt.profile, f)
+			require.NoError(t, err)
+			require.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func Test_genFilePath_truncateRunes(t *testing.T) {
+	t.Parallel()
+
+	var fields pathFields
+	fields.Subreddit = "wallpapers"
+	fields.Name = "xyz"
+	fields.Ext = "jpg"
+	// 4 bytes per rune, so most lengths split one
+	fields.Title = strings.Repeat("🌄", 100)
+
+	got, err := genFilePath("/pics/a", defaultPathTemplate, sanitizePosix, fields)
+	require.NoError(t, err)
+	require.LessOrEqual(t, len(got), maxPathLength)
+	require.True(t, utf8.ValidString(got))
+	require.True(t, strings.HasSuffix(got, "_xyz.jpg"))
+	// as much of the title as fits is kept
+	require.Greater(t, len(got), maxPathLength-4)
+}
@@ -3,16 +3,33 @@ package main
 import (
 	"fmt"
 	"math"
+	"reflect"
 	"strconv"
 	"strings"
+	"time"
 
 	"go.bbkane.com/warg/value/contained"
 )
 
 type SubredditInfo struct {
 	Subreddit string
+	// Sort is one of the sort* constants
+	Sort string
+	// Timeframe is empty unless Sort uses one
 	Timeframe string
 	Count     int
+	// EnableResolvers limits which resolvers are used. Empty means all
+	EnableResolvers  []string
+	DisableResolvers []string
+	// Filter overrides the global image filter's non-zero fields
+	Filter imageFilter
+	// Search lists posts matching a Reddit search query instead of the subreddit's listing
+	Search string
+	Flairs flairFilter
+	// Destination overrides --destination when not empty. It's expanded when grabbing
+	Destination string
+	// TimeBudget limits how long the subreddit is grabbed for. 0 means no limit
+	TimeBudget time.Duration
 }
 
 // nolint: gochecknoglobals // readonly map used for validation
@@ -24,28 +41,205 @@ var validTimeFrames = map[string]bool{
 	"all":   true,
 }
 
+// Listing sorts
+const (
+	sortTop           = "top"
+	sortHot           = "hot"
+	sortNew           = "new"
+	sortRising        = "rising"
+	sortControversial = "controversial"
+)
+
+// validSorts maps each sort to whether it needs a timeframe
+// nolint: gochecknoglobals // readonly map used for validation
+var validSorts = map[string]bool{
+	sortTop:           true,
+	sortHot:           false,
+	sortNew:           false,
+	sortRising:        false,
+	sortControversial: true,
+}
+
+// validateListing checks the sort is known, and that it has a timeframe only if it uses one
+func validateListing(sort string, timeframe string) error {
+	needsTimeframe, ok := validSorts[sort]
+	if !ok {
+		return fmt.Errorf("invalid sort in SubredditInfo: %s", sort)
+	}
+	if needsTimeframe && !validTimeFrames[timeframe] {
+		return fmt.Errorf("invalid timeframe for sort %s in SubredditInfo: %#v", sort, timeframe)
+	}
+	if !needsTimeframe && timeframe != "" {
+		return fmt.Errorf("sort %s doesn't use a timeframe in SubredditInfo: %s", sort, timeframe)
+	}
+	return nil
+}
+
+// validSearchSorts are the sorts Reddit's search endpoint supports
+// nolint: gochecknoglobals // readonly map used for validation
+var validSearchSorts = map[string]bool{
+	sortTop: true,
+	sortHot: true,
+	sortNew: true,
+}
+
+func validateSearch(search string, sort string) error {
+	if search != "" && !validSearchSorts[sort] {
+		return fmt.Errorf("sort %s can't be used with search in SubredditInfo", sort)
+	}
+	return nil
+}
+
+// parseListing parses a FromString listing: <timeframe> (meaning top), <sort>, or <sort>:<timeframe>
+func parseListing(s string) (string, string, error) {
+	sort, timeframe, found := strings.Cut(s, ":")
+	if !found && validTimeFrames[s] {
+		sort, timeframe = sortTop, s
+	}
+	if err := validateListing(sort, timeframe); err != nil {
+		return "", "", err
+	}
+	return sort, timeframe, nil
+}
+
+// listSeparator separates list items in FromString options
+const listSeparator = "+"
+
+func parseAspectRatios(ratios []string) ([]aspectRatio, error) {
+	var ret []aspectRatio
+	for _, r := range ratios {
+		ratio, err := parseAspectRatio(r)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, ratio)
+	}
+	return ret, nil
+}
+
+// parseTimeBudget parses a subreddit's timebudget, like 5m
+func parseTimeBudget(s string) (time.Duration, error) {
+	budget, err := time.ParseDuration(s)
+	if err != nil || budget <= 0 {
+		return 0, fmt.Errorf("invalid timebudget in SubredditInfo: %s", s)
+	}
+	return budget, nil
+}
+
+func validateResolverNames(names []string) error {
+	for _, name := range names {
+		if !validResolverNames[name] {
+			return fmt.Errorf("invalid resolver in SubredditInfo: %s", name)
+		}
+	}
+	return nil
+}
+
+// setOption sets an optional SubredditInfo field from a FromString key=value pair
+func (si *SubredditInfo) setOption(key string, value string) error {
+	switch key {
+	case "enableresolvers":
+		si.EnableResolvers = strings.Split(value, listSeparator)
+		return validateResolverNames(si.EnableResolvers)
+	case "disableresolvers":
+		si.DisableResolvers = strings.Split(value, listSeparator)
+		return validateResolverNames(si.DisableResolvers)
+	case "minwidth", "minheight":
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 {
+			return fmt.Errorf("invalid %s in SubredditInfo: %s", key, value)
+		}
+		if key == "minwidth" {
+			si.Filter.MinWidth = n
+		} else {
+			si.Filter.MinHeight = n
+		}
+		return nil
+	case "aspectratios":
+		var err error
+		si.Filter.AspectRatios, err = parseAspectRatios(strings.Split(value, listSeparator))
+		return err
+	case "search":
+		si.Search = value
+		if err := validateSource(si.Subreddit, si.Sort, si.Search); err != nil {
+			return err
+		}
+		return validateSearch(si.Search, si.Sort)
+	case "allowflairs":
+		si.Flairs.Allow = strings.Split(value, listSeparator)
+		return nil
+	case "denyflairs":
+		si.Flairs.Deny = strings.Split(value, listSeparator)
+		return nil
+	case "destination":
+		si.Destination = value
+		return nil
+	case "timebudget":
+		var err error
+		si.TimeBudget, err = parseTimeBudget(value)
+		return err
+	default:
+		return fmt.Errorf("unknown option in SubredditInfo: %s", key)
+	}
+}
+
 func FromString(s string) (SubredditInfo, error) {
-	// Expected format: <subreddit>,<day|week|month|year>,<count>
+	// Expected format: <subreddit>,<listing>,<count>[,<key>=<value>...]
+	// where <listing> is <day|week|month|year|all>, <hot|new|rising>, or <top|controversial>:<day|week|month|year|all>
 	parts := strings.Split(s, ",")
-	if len(parts) != 3 {
+	if len(parts) < 3 {
 		return SubredditInfo{}, fmt.Errorf("invalid format for SubredditInfo: %s", s)
 	}
 	count, err := strconv.Atoi(parts[2])
 	if err != nil {
 		return SubredditInfo{}, fmt.Errorf("invalid count in SubredditInfo: %s", parts[2])
 	}
-	timeFrame := parts[1]
-	if !validTimeFrames[timeFrame] {
-		return SubredditInfo{}, fmt.Errorf("invalid timeframe in SubredditInfo: %s", timeFrame)
+	sort, timeFrame, err := parseListing(parts[1])
+	if err != nil {
+		return SubredditInfo{}, err
 	}
-	return SubredditInfo{
-		Subreddit: parts[0],
-		Timeframe: timeFrame,
-		Count:     count,
-	}, nil
+	if err := validateSource(parts[0], sort, ""); err != nil {
+		return SubredditInfo{}, err
+	}
+	var si SubredditInfo
+	si.Subreddit = parts[0]
+	si.Sort = sort
+	si.Timeframe = timeFrame
+	si.Count = count
+	for _, option := range parts[3:] {
+		key, value, found := strings.Cut(option, "=")
+		if !found {
+			return SubredditInfo{}, fmt.Errorf("expected <key>=<value> option in SubredditInfo: %s", option)
+		}
+		if err := si.setOption(key, value); err != nil {
+			return SubredditInfo{}, err
+		}
+	}
+	return si, nil
 
 }
 
+// stringSliceFromIFace returns an optional list of strings from a YAML map
+func stringSliceFromIFace(m map[string]interface{}, key string) ([]string, error) {
+	v, exists := m[key]
+	if !exists || v == nil {
+		return nil, nil
+	}
+	items, ok := v.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("expected %s to be a list, got %T", key, v)
+	}
+	ret := make([]string, 0, len(items))
+	for _, item := range items {
+		str, ok := item.(string)
+		if !ok {
+			return nil, fmt.Errorf("expected %s items to be string, got %T", key, item)
+		}
+		ret = append(ret, str)
+	}
+	return ret, nil
+}
+
 func FromIFace(iFace interface{}) (SubredditInfo, error) {
 	m, ok := iFace.(map[string]interface{})
 	if !ok {
@@ -55,12 +249,19 @@ func FromIFace(iFace interface{}) (SubredditInfo, error) {
 	if !ok {
 		return SubredditInfo{}, fmt.Errorf("expected subreddit to be string, got %T", m["subreddit"])
 	}
-	timeframe, ok := m["timeframe"].(string)
-	if !ok {
-		return SubredditInfo{}, fmt.Errorf("expected timeframe to be string, got %T", m["timeframe"])
+	sort, err := optionalStringFromIFace(m, "sort")
+	if err != nil {
+		return SubredditInfo{}, err
+	}
+	if sort == "" {
+		sort = sortTop
 	}
-	if !validTimeFrames[timeframe] {
-		return SubredditInfo{}, fmt.Errorf("invalid timeframe in SubredditInfo: %s", timeframe)
+	timeframe, err := optionalStringFromIFace(m, "timeframe")
+	if err != nil {
+		return SubredditInfo{}, err
+	}
+	if err := validateListing(sort, timeframe); err != nil {
+		return SubredditInfo{}, err
 	}
 	count, ok := m["count"].(uint64) // YAML numbers are decoded as uint64
 	if !ok {
@@ -69,19 +270,131 @@ func FromIFace(iFace interface{}) (SubredditInfo, error) {
 	if count > math.MaxInt {
 		return SubredditInfo{}, fmt.Errorf("count too large: %d", count)
 	}
+	enableResolvers, err := stringSliceFromIFace(m, "enableresolvers")
+	if err != nil {
+		return SubredditInfo{}, err
+	}
+	if err := validateResolverNames(enableResolvers); err != nil {
+		return SubredditInfo{}, err
+	}
+	disableResolvers, err := stringSliceFromIFace(m, "disableresolvers")
+	if err != nil {
+		return SubredditInfo{}, err
+	}
+	if err := validateResolverNames(disableResolvers); err != nil {
+		return SubredditInfo{}, err
+	}
+	minWidth, err := optionalIntFromIFace(m, "minwidth")
+	if err != nil {
+		return SubredditInfo{}, err
+	}
+	minHeight, err := optionalIntFromIFace(m, "minheight")
+	if err != nil {
+		return SubredditInfo{}, err
+	}
+	aspectRatioStrs, err := stringSliceFromIFace(m, "aspectratios")
+	if err != nil {
+		return SubredditInfo{}, err
+	}
+	aspectRatios, err := parseAspectRatios(aspectRatioStrs)
+	if err != nil {
+		return SubredditInfo{}, err
+	}
+	search, err := optionalStringFromIFace(m, "search")
+	if err != nil {
+		return SubredditInfo{}, err
+	}
+	if err := validateSearch(search, sort); err != nil {
+		return SubredditInfo{}, err
+	}
+	if err := validateSource(subreddit, sort, search); err != nil {
+		return SubredditInfo{}, err
+	}
+	allowFlairs, err := stringSliceFromIFace(m, "allowflairs")
+	if err != nil {
+		return SubredditInfo{}, err
+	}
+	denyFlairs, err := stringSliceFromIFace(m, "denyflairs")
+	if err != nil {
+		return SubredditInfo{}, err
+	}
+	destination, err := optionalStringFromIFace(m, "destination")
+	if err != nil {
+		return SubredditInfo{}, err
+	}
+	timeBudgetStr, err := optionalStringFromIFace(m, "timebudget")
+	if err != nil {
+		return SubredditInfo{}, err
+	}
+	var timeBudget time.Duration
+	if timeBudgetStr != "" {
+		timeBudget, err = parseTimeBudget(timeBudgetStr)
+		if err != nil {
+			return SubredditInfo{}, err
+		}
+	}
 	return SubredditInfo{
-		Subreddit: subreddit,
-		Timeframe: timeframe,
-		Count:     int(count),
+		Subreddit:        subreddit,
+		Sort:             sort,
+		Timeframe:        timeframe,
+		Count:            int(count),
+		EnableResolvers:  enableResolvers,
+		DisableResolvers: disableResolvers,
+		Filter: imageFilter{
+			MinWidth:     minWidth,
+			MinHeight:    minHeight,
+			AspectRatios: aspectRatios,
+		},
+		Search: search,
+		Flairs: flairFilter{
+			Allow: allowFlairs,
+			Deny:  denyFlairs,
+		},
+		Destination: destination,
+		TimeBudget:  timeBudget,
 	}, nil
 }
 
+// optionalStringFromIFace returns an optional string from a YAML map, or "" if it's missing
+func optionalStringFromIFace(m map[string]interface{}, key string) (string, error) {
+	v, exists := m[key]
+	if !exists || v == nil {
+		return "", nil
+	}
+	str, ok := v.(string)
+	if !ok {
+		return "", fmt.Errorf("expected %s to be string, got %T", key, v)
+	}
+	return str, nil
+}
+
+// optionalIntFromIFace returns an optional non-negative int from a YAML map, or 0 if it's missing
+func optionalIntFromIFace(m map[string]interface{}, key string) (int, error) {
+	v, exists := m[key]
+	if !exists || v == nil {
+		return 0, nil
+	}
+	n, ok := v.(uint64) // YAML numbers are decoded as uint64
+	if !ok {
+		return 0, fmt.Errorf("expected %s to be uint64, got %T", key, v)
+	}
+	if n > math.MaxInt {
+		return 0, fmt.Errorf("%s too large: %d", key, n)
+	}
+	return int(n), nil
+}
+
+// subredditInfoEquals is needed because SubredditInfo's slices make it incomparable
+func subredditInfoEquals(a SubredditInfo, b SubredditInfo) bool {
+	return reflect.DeepEqual(a, b)
+}
+
 func SubredditInfoTypeInfo() contained.TypeInfo[SubredditInfo] {
 	return contained.TypeInfo[SubredditInfo]{
-		Description: "SubredditInfo represents a subreddit, timeframe, and count",
+		Description: "SubredditInfo represents a subreddit, sort, timeframe, count, and options",
 		FromIFace:   FromIFace,
 		FromString:  FromString,
 		FromZero:    contained.FromZero[SubredditInfo],
-		Equals:      contained.Equals[SubredditInfo],
+		Equals:      subredditInfoEquals,
 	}
 }
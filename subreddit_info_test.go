@@ -0,0 +1,391 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestFromString(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		name    string
+		s       string
+		want    SubredditInfo
+		wantErr bool
+	}{
+		{
+			name: "three fields",
+			s:    "wallpapers,week,5",
+			want: SubredditInfo{
+				Subreddit:        "wallpapers",
+				Sort:             "top",
+				Timeframe:        "week",
+				Count:            5,
+				EnableResolvers:  nil,
+				DisableResolvers: nil,
+				Filter: imageFilter{
+					MinWidth:     0,
+					MinHeight:    0,
+					AspectRatios: nil,
+				},
+				Search: "",
+				Flairs: flairFilter{
+					Allow: nil,
+					Deny:  nil,
+				},
+				Destination: "",
+				TimeBudget:  0,
+			},
+			wantErr: false,
+		},
+		{
+			name: "resolvers",
+			s:    "wallpapers,week,5,enableresolvers=direct+gallery,disableresolvers=imgur",
+			want: SubredditInfo{
+				Subreddit:        "wallpapers",
+				Sort:             "top",
+				Timeframe:        "week",
+				Count:            5,
+				EnableResolvers:  []string{"direct", "gallery"},
+				DisableResolvers: []string{"imgur"},
+				Filter: imageFilter{
+					MinWidth:     0,
+					MinHeight:    0,
+					AspectRatios: nil,
+				},
+				Search: "",
+				Flairs: flairFilter{
+					Allow: nil,
+					Deny:  nil,
+				},
+				Destination: "",
+				TimeBudget:  0,
+			},
+			wantErr: false,
+		},
+		{
+			name: "filters",
+			s:    "wallpapers,week,5,minwidth=1920,minheight=1080,aspectratios=16:9~5%+16:10",
+			want: SubredditInfo{
+				Subreddit:        "wallpapers",
+				Sort:             "top",
+				Timeframe:        "week",
+				Count:            5,
+				EnableResolvers:  nil,
+				DisableResolvers: nil,
+				Filter: imageFilter{
+					MinWidth:  1920,
+					MinHeight: 1080,
+					AspectRatios: []aspectRatio{
+						{Width: 16, Height: 9, Tolerance: 5},
+						{Width: 16, Height: 10, Tolerance: 0},
+					},
+				},
+				Search: "",
+				Flairs: flairFilter{
+					Allow: nil,
+					Deny:  nil,
+				},
+				Destination: "",
+				TimeBudget:  0,
+			},
+			wantErr: false,
+		},
+		{
+			name: "sort without timeframe",
+			s:    "wallpapers,hot,5",
+			want: SubredditInfo{
+				Subreddit:        "wallpapers",
+				Sort:             "hot",
+				Timeframe:        "",
+				Count:            5,
+				EnableResolvers:  nil,
+				DisableResolvers: nil,
+				Filter: imageFilter{
+					MinWidth:     0,
+					MinHeight:    0,
+					AspectRatios: nil,
+				},
+				Search: "",
+				Flairs: flairFilter{
+					Allow: nil,
+					Deny:  nil,
+				},
+				Destination: "",
+				TimeBudget:  0,
+			},
+			wantErr: false,
+		},
+		{
+			name: "sort with timeframe",
+			s:    "wallpapers,controversial:month,5",
+			want: SubredditInfo{
+				Subreddit:        "wallpapers",
+				Sort:             "controversial",
+				Timeframe:        "month",
+				Count:            5,
+				EnableResolvers:  nil,
+				DisableResolvers: nil,
+				Filter: imageFilter{
+					MinWidth:     0,
+					MinHeight:    0,
+					AspectRatios: nil,
+				},
+				Search: "",
+				Flairs: flairFilter{
+					Allow: nil,
+					Deny:  nil,
+				},
+				Destination: "",
+				TimeBudget:  0,
+			},
+			wantErr: false,
+		},
+		{
+			name: "search and flairs",
+			s:    "wallpapers,new,5,search=mountain lake,allowflairs=Desktop+Mobile,denyflairs=Meta",
+			want: SubredditInfo{
+				Subreddit:        "wallpapers",
+				Sort:             "new",
+				Timeframe:        "",
+				Count:            5,
+				EnableResolvers:  nil,
+				DisableResolvers: nil,
+				Filter: imageFilter{
+					MinWidth:     0,
+					MinHeight:    0,
+					AspectRatios: nil,
+				},
+				Search: "mountain lake",
+				Flairs: flairFilter{
+					Allow: []string{"Desktop", "Mobile"},
+					Deny:  []string{"Meta"},
+				},
+				Destination: "",
+				TimeBudget:  0,
+			},
+			wantErr: false,
+		},
+		{
+			name: "multireddit",
+			s:    "user/bob/m/landscapes,week,5",
+			want: SubredditInfo{
+				Subreddit:        "user/bob/m/landscapes",
+				Sort:             "top",
+				Timeframe:        "week",
+				Count:            5,
+				EnableResolvers:  nil,
+				DisableResolvers: nil,
+				Filter: imageFilter{
+					MinWidth:     0,
+					MinHeight:    0,
+					AspectRatios: nil,
+				},
+				Search: "",
+				Flairs: flairFilter{
+					Allow: nil,
+					Deny:  nil,
+				},
+				Destination: "",
+				TimeBudget:  0,
+			},
+			wantErr: false,
+		},
+		{
+			name: "destination",
+			s:    "cityporn,hot,5,destination=~/Pictures/cities",
+			want: SubredditInfo{
+				Subreddit:        "cityporn",
+				Sort:             "hot",
+				Timeframe:        "",
+				Count:            5,
+				EnableResolvers:  nil,
+				DisableResolvers: nil,
+				Filter: imageFilter{
+					MinWidth:     0,
+					MinHeight:    0,
+					AspectRatios: nil,
+				},
+				Search: "",
+				Flairs: flairFilter{
+					Allow: nil,
+					Deny:  nil,
+				},
+				Destination: "~/Pictures/cities",
+				TimeBudget:  0,
+			},
+			wantErr: false,
+		},
+		{
+			name: "time budget",
+			s:    "wallpapers,week,5,timebudget=5m",
+			want: SubredditInfo{
+				Subreddit:        "wallpapers",
+				Sort:             "top",
+				Timeframe:        "week",
+				Count:            5,
+				EnableResolvers:  nil,
+				DisableResolvers: nil,
+				Filter: imageFilter{
+					MinWidth:     0,
+					MinHeight:    0,
+					AspectRatios: nil,
+				},
+				Search: "",
+				Flairs: flairFilter{
+					Allow: nil,
+					Deny:  nil,
+				},
+				Destination: "",
+				TimeBudget:  5 * time.Minute,
+			},
+			wantErr: false,
+		},
+		{
+			name:    "zero time budget",
+			s:       "wallpapers,week,5,timebudget=0s",
+			want:    SubredditInfo{},
+			wantErr: true,
+		},
+		{
+			name:    "user with search",
+			s:       "user/bob,new,5,search=mountain",
+			want:    SubredditInfo{},
+			wantErr: true,
+		},
+		{
+			name:    "search with unsupported sort",
+			s:       "wallpapers,rising,5,search=mountain",
+			want:    SubredditInfo{},
+			wantErr: true,
+		},
+		{
+			name:    "sort missing timeframe",
+			s:       "wallpapers,top,5",
+			want:    SubredditInfo{},
+			wantErr: true,
+		},
+		{
+			name:    "timeframe for sort without one",
+			s:       "wallpapers,new:week,5",
+			want:    SubredditInfo{},
+			wantErr: true,
+		},
+		{
+			name:    "too few fields",
+			s:       "wallpapers,week",
+			want:    SubredditInfo{},
+			wantErr: true,
+		},
+		{
+			name:    "bad timeframe",
+			s:       "wallpapers,fortnight,5",
+			want:    SubredditInfo{},
+			wantErr: true,
+		},
+		{
+			name:    "unknown resolver",
+			s:       "wallpapers,week,5,enableresolvers=flickr",
+			want:    SubredditInfo{},
+			wantErr: true,
+		},
+		{
+			name:    "option without value",
+			s:       "wallpapers,week,5,enableresolvers",
+			want:    SubredditInfo{},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := FromString(tt.s)
+			if tt.wantErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestFromIFace(t *testing.T) {
+	t.Parallel()
+
+	got, err := FromIFace(map[string]interface{}{
+		"name":             "wallpapers",
+		"timeframe":        "week",
+		"count":            uint64(5),
+		"disableresolvers": []interface{}{"imgur"},
+		"minheight":        uint64(1080),
+	})
+	require.NoError(t, err)
+	require.Equal(t, SubredditInfo{
+		Subreddit:        "wallpapers",
+		Sort:             "top",
+		Timeframe:        "week",
+		Count:            5,
+		EnableResolvers:  nil,
+		DisableResolvers: []string{"imgur"},
+		Filter: imageFilter{
+			MinWidth:     0,
+			MinHeight:    1080,
+			AspectRatios: nil,
+		},
+		Search: "",
+		Flairs: flairFilter{
+			Allow: nil,
+			Deny:  nil,
+		},
+		Destination: "",
+		TimeBudget:  0,
+	}, got)
+
+	_, err = FromIFace(map[string]interface{}{
+		"name":            "wallpapers",
+		"timeframe":       "week",
+		"count":           uint64(5),
+		"enableresolvers": "imgur",
+	})
+	require.Error(t, err)
+	got, err = FromIFace(map[string]interface{}{
+		"name":  "wallpapers",
+		"sort":  "rising",
+		"count": uint64(5),
+	})
+	require.NoError(t, err)
+	require.Equal(t, "rising", got.Sort)
+	require.Equal(t, "", got.Timeframe)
+
+	_, err = FromIFace(map[string]interface{}{
+		"name":  "wallpapers",
+		"sort":  "top",
+		"count": uint64(5),
+	})
+	require.Error(t, err)
+	got, err = FromIFace(map[string]interface{}{
+		"name":        "wallpapers",
+		"timeframe":   "week",
+		"count":       uint64(5),
+		"search":      "mountain",
+		"denyflairs":  []interface{}{"Meta"},
+		"allowflairs": []interface{}{"Desktop"},
+		"destination": "~/Pictures/walls",
+		"timebudget":  "90s",
+	})
+	require.NoError(t, err)
+	require.Equal(t, "mountain", got.Search)
+	require.Equal(t, flairFilter{Allow: []string{"Desktop"}, Deny: []string{"Meta"}}, got.Flairs)
+	require.Equal(t, "~/Pictures/walls", got.Destination)
+	require.Equal(t, 90*time.Second, got.TimeBudget)
+
+	_, err = FromIFace(map[string]interface{}{
+		"name":       "wallpapers",
+		"timeframe":  "week",
+		"count":      uint64(5),
+		"timebudget": "soon",
+	})
+	require.Error(t, err)
+}
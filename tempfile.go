@@ -0,0 +1,128 @@
+package main
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Downloads are written to hidden partial files next to their destination
+// and renamed into place when complete, so an interrupted download never
+// leaves a truncated image under the real name
+const tempFilePrefix = ".grabbit-"
+
+// renameNoReplace moves tempName to fileName. Unlike os.Rename, it fails
+// with an fs.ErrExist error if fileName exists
+func renameNoReplace(tempName string, fileName string) error {
+	err := os.Link(tempName, fileName)
+	if err == nil {
+		return errors.WithStack(os.Remove(tempName))
+	}
+	if errors.Is(err, fs.ErrExist) {
+		return errors.WithStack(err)
+	}
+	// the filesystem doesn't support hard links, so check first. This
+	// races with other writers of fileName, but they're unlikely
+	if _, statErr := os.Lstat(fileName); statErr == nil {
+		return errors.WithStack(&fs.PathError{Op: "rename", Path: fileName, Err: fs.ErrExist})
+	}
+	return errors.WithStack(os.Rename(tempName, fileName))
+}
+
+// sweepPartialFiles removes partial files under dir last modified before
+// before. Newer files can still be resumed
+func sweepPartialFiles(dir string, before time.Time) ([]string, error) {
+	var removed []string
+	err := filepath.WalkDir(dir, func(filePath string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() || !isPartialFile(d.Name()) {
+			return nil
+		}
+		info, err := d.Info()
+		if errors.Is(err, fs.ErrNotExist) {
+			// finished since the directory was read
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if !info.ModTime().Before(before) {
+			return nil
+		}
+		err = os.Remove(filePath)
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		removed = append(removed, filePath)
+		return nil
+	})
+	if err != nil {
+		return removed, errors.Wrapf(err, "could not sweep partial files: %#v", dir)
+	}
+	return removed, nil
+}
+
+// partialFileSweeper sweeps each destination directory once per run
+type partialFileSweeper struct {
+	mu sync.Mutex
+	// before is the cutoff: partial files older than it are removed
+	before time.Time
+	swept  map[string]bool
+}
+
+func newPartialFileSweeper(before time.Time) *partialFileSweeper {
+	return &partialFileSweeper{
+		mu:     sync.Mutex{},
+		before: before,
+		swept:  make(map[string]bool),
+	}
+}
+
+// sweep removes old partial files under dir the first time it's called for
+// dir, and returns them
+func (s *partialFileSweeper) sweep(dir string) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.swept[dir] {
+		return nil, nil
+	}
+	s.swept[dir] = true
+	return sweepPartialFiles(dir, s.before)
+}
+
+// fileClaims tracks the files being downloaded, so concurrent downloads to
+// the same file name don't write to the same partial file
+type fileClaims struct {
+	mu    sync.Mutex
+	paths map[string]bool
+}
+
+func newFileClaims() *fileClaims {
+	return &fileClaims{
+		mu:    sync.Mutex{},
+		paths: make(map[string]bool),
+	}
+}
+
+// claim returns false if filePath is already claimed
+func (c *fileClaims) claim(filePath string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.paths[filePath] {
+		return false
+	}
+	c.paths[filePath] = true
+	return true
+}
+
+func (c *fileClaims) release(filePath string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.paths, filePath)
+}
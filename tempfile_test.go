@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_sweepPartialFiles(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	require.NoError(t, os.Mkdir(filepath.Join(dir, "sub"), 0755))
+
+	old := []string{
+		filepath.Join(dir, tempFilePrefix+"1"+partialFileSuffix),
+		filepath.Join(dir, "sub", tempFilePrefix+"1"+partialMetaSuffix),
+	}
+	kept := []string{
+		filepath.Join(dir, "image.jpg"),
+		filepath.Join(dir, "notes.part"),
+		// a download that can still be resumed
+		filepath.Join(dir, tempFilePrefix+"2"+partialFileSuffix),
+	}
+	before := time.Now().Add(-partialMaxAge)
+	for _, f := range append(old, kept...) {
+		require.NoError(t, os.WriteFile(f, []byte("x"), 0600))
+	}
+	for _, f := range append(old, kept[:2]...) {
+		require.NoError(t, os.Chtimes(f, before.Add(-time.Hour), before.Add(-time.Hour)))
+	}
+
+	sweeper := newPartialFileSweeper(before)
+	removed, err := sweeper.sweep(dir)
+	require.NoError(t, err)
+	require.ElementsMatch(t, old, removed)
+	for _, f := range old {
+		require.NoFileExists(t, f)
+	}
+	for _, f := range kept {
+		require.FileExists(t, f)
+	}
+
+	// each directory is only swept once
+	removed, err = sweeper.sweep(dir)
+	require.NoError(t, err)
+	require.Empty(t, removed)
+}
+
+func Test_renameNoReplace(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	temp := filepath.Join(dir, tempFilePrefix+"1"+partialFileSuffix)
+	fileName := filepath.Join(dir, "image.jpg")
+
+	require.NoError(t, os.WriteFile(temp, []byte("new"), 0600))
+	require.NoError(t, os.WriteFile(fileName, []byte("old"), 0600))
+	err := renameNoReplace(temp, fileName)
+	require.True(t, os.IsExist(errors.Cause(err)))
+	content, err := os.ReadFile(fileName)
+	require.NoError(t, err)
+	require.Equal(t, "old", string(content))
+
+	require.NoError(t, os.Remove(fileName))
+	require.NoError(t, renameNoReplace(temp, fileName))
+	content, err = os.ReadFile(fileName)
+	require.NoError(t, err)
+	require.Equal(t, "new", string(content))
+	require.NoFileExists(t, temp)
+}
+
+func Test_downloadImage_atomic(t *testing.T) {
+	t.Parallel()
+
+	var buf bytes.Buffer
+	err := png.Encode(&buf, image.NewGray(image.Rect(0, 0, 64, 48)))
+	require.NoError(t, err)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/truncated" {
+			// promise more than is sent, then close the connection
+			w.Header().Set("Content-Length", strconv.Itoa(buf.Len()+1000))
+			w.WriteHeader(http.StatusOK)
+			_, _ = w.Write(buf.Bytes())
+			conn, _, err := http.NewResponseController(w).Hijack()
+			if err == nil {
+				conn.Close()
+			}
+			return
+		}
+		_, _ = w.Write(buf.Bytes())
+	}))
+	defer server.Close()
+
+	var noFilter imageFilter
+	dir := t.TempDir()
+
+	truncatedPath := filepath.Join(dir, "truncated.png")
+	_, err = downloadImage(t.Context(), server.Client(), server.URL+"/truncated", truncatedPath, noFilter, 0, 0)
+	require.Error(t, err)
+	require.NoFileExists(t, truncatedPath)
+
+	existingPath := filepath.Join(dir, "existing.png")
+	require.NoError(t, os.WriteFile(existingPath, []byte("old"), 0600))
+	_, err = downloadImage(t.Context(), server.Client(), server.URL, existingPath, noFilter, 0, 0)
+	require.True(t, os.IsExist(errors.Cause(err)))
+
+	// without an ETag or Last-Modified, partial files can't be resumed, so they're removed
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	require.Equal(t, "existing.png", entries[0].Name())
+}